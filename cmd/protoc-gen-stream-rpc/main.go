@@ -26,11 +26,15 @@ func getServiceDir(baseDir string) string {
 // 1. Client code (_client.pb.go) - only for files with services
 // 2. Server interfaces (_server.pb.go) - only for files with services
 // 3. Service implementation skeletons in the service/ directory - only for files with services
+//
+// Passing legacy_client=true generates unary client methods with the old
+// Method(req) *Resp signature instead of Method(ctx, req, opts...) (*Resp, error).
 func main() {
 	var (
-		flags flag.FlagSet
-		_     = flags.String("go_out", "", "")
-		_     = flags.String("go_opt", "", "")
+		flags        flag.FlagSet
+		_            = flags.String("go_out", "", "")
+		_            = flags.String("go_opt", "", "")
+		legacyClient = flags.Bool("legacy_client", false, "generate unary client methods without context and error results")
 	)
 
 	protogen.Options{ParamFunc: flags.Set}.Run(func(gen *protogen.Plugin) error {
@@ -58,9 +62,11 @@ func main() {
 				methods := make([]generator.Method, 0)
 				for _, method := range service.Methods {
 					methods = append(methods, generator.Method{
-						Name:       method.GoName,
-						InputType:  method.Input.GoIdent.GoName,
-						OutputType: method.Output.GoIdent.GoName,
+						Name:            method.GoName,
+						InputType:       method.Input.GoIdent.GoName,
+						OutputType:      method.Output.GoIdent.GoName,
+						ClientStreaming: method.Desc.IsStreamingClient(),
+						ServerStreaming: method.Desc.IsStreamingServer(),
 					})
 				}
 
@@ -69,6 +75,7 @@ func main() {
 					ProtoPackage: string(f.GoImportPath),
 					ServiceName:  service.GoName,
 					Methods:      methods,
+					LegacyClient: *legacyClient,
 				}
 
 				// Generate client code
@@ -83,16 +83,16 @@ func main() {
 			a, b := int32(i), int32(i+1)
 
 			// Much simpler RPC calls
-			addResp := calculatorClient.Add(&proto.AddRequest{A: a, B: b})
-			if addResp == nil {
-				log.Printf("Add error: nil response\n")
+			addResp, err := calculatorClient.Add(ctx, &proto.AddRequest{A: a, B: b})
+			if err != nil {
+				log.Printf("Add error: %v\n", err)
 				continue
 			}
 			fmt.Printf("Client: %d + %d = %d\n", a, b, addResp.Result)
 
-			mulResp := calculatorClient.Multiply(&proto.MultiplyRequest{A: a, B: b})
-			if mulResp == nil {
-				log.Printf("Multiply error: nil response\n")
+			mulResp, err := calculatorClient.Multiply(ctx, &proto.MultiplyRequest{A: a, B: b}, rpc.CallTimeout(time.Second))
+			if err != nil {
+				log.Printf("Multiply error: %v\n", err)
 				continue
 			}
 			fmt.Printf("Client: %d * %d = %d\n", a, b, mulResp.Result)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,8 +11,6 @@ import (
 	proto "github.com/jibuji/go-stream-rpc/examples/calculator/proto"
 	calculator "github.com/jibuji/go-stream-rpc/examples/calculator/proto/service"
 	"github.com/jibuji/go-stream-rpc/rpc"
-	"github.com/jibuji/go-stream-rpc/session"
-	stream "github.com/jibuji/go-stream-rpc/stream/libp2p"
 
 	"crypto/rand"
 	"encoding/hex"
@@ -18,62 +18,47 @@ import (
 
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
-	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 )
 
 const protocolID = "/calculator/1.0.0"
 
-func makeServerCalculation(peer *rpc.RpcPeer, a, b int32) {
+func makeServerCalculation(peer *rpc.RpcPeer, a, b int32) error {
 	calculatorClient := proto.NewCalculatorClient(peer)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	// Test Add
 	addReq := &proto.AddRequest{A: a, B: b}
-	addResp := calculatorClient.Add(addReq)
-	if addResp == nil {
-		log.Printf("Server Add error: nil response\n")
-		return
+	addResp, err := calculatorClient.Add(ctx, addReq)
+	if err != nil {
+		log.Printf("Server Add error: %v\n", err)
+		return err
 	}
 	fmt.Printf("Server: %d + %d = %d\n", a, b, addResp.Result)
 
 	// Test Multiply
 	mulReq := &proto.MultiplyRequest{A: a, B: b}
-	mulResp := calculatorClient.Multiply(mulReq)
-	if mulResp == nil {
-		log.Printf("Server Multiply error: nil response\n")
-		return
+	mulResp, err := calculatorClient.Multiply(ctx, mulReq)
+	if err != nil {
+		log.Printf("Server Multiply error: %v\n", err)
+		return err
 	}
 	fmt.Printf("Server: %d * %d = %d\n", a, b, mulResp.Result)
+	return nil
 }
 
-func handleStream(s network.Stream) {
-	log.Printf("New connection from: %s\n", s.Conn().RemotePeer())
-
-	libp2pStream := stream.NewLibP2PStream(s)
-
-	// Create custom session if needed
-	customSession := session.NewMemSession()
-
-	// Create a new RPC peer with custom session
-	peer := rpc.NewRpcPeer(libp2pStream, rpc.WithSession(customSession))
-	defer peer.Close()
-
-	// Register the calculator service
-	proto.RegisterCalculatorServer(peer, &calculator.CalculatorService{})
-
-	// Start periodic calculations
+// calculatePeriodically calls the client back until the connection ends.
+func calculatePeriodically(peer *rpc.RpcPeer) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	counter := int32(100)
-	for {
-		select {
-		case err := <-peer.ErrorChannel():
-			log.Printf("encounter error: %v\n", err)
+	for range ticker.C {
+		if err := makeServerCalculation(peer, counter, counter+5); errors.Is(err, rpc.ErrPeerClosed) {
 			return
-		case <-ticker.C:
-			makeServerCalculation(peer, counter, counter+5)
-			counter += 5
 		}
+		counter += 5
 	}
 }
 
@@ -144,9 +129,17 @@ func main() {
 		fmt.Printf("  - %s/p2p/%s\n", addr, h.ID())
 	}
 
-	// Set up the RPC handler
-	h.SetStreamHandler(protocolID, handleStream)
+	// Serve the calculator on every stream opened with the protocol
+	server := rpc.NewServer(
+		rpc.OnConnect(func(peer *rpc.RpcPeer) {
+			log.Println("New connection")
+			go calculatePeriodically(peer)
+		}),
+		rpc.OnDisconnect(func(peer *rpc.RpcPeer, err error) {
+			log.Printf("Connection closed: %v\n", err)
+		}),
+	)
+	proto.RegisterCalculatorServer(server, &calculator.CalculatorService{})
 
-	// Keep the server running
-	select {}
+	log.Fatal(server.ServeLibp2p(h, protocolID))
 }
@@ -4,6 +4,7 @@ package service
 import (
 	"context"
 	proto "github.com/jibuji/go-stream-rpc/examples/calculator/proto"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
 )
 
 // CalculatorService implements the Calculator service
@@ -11,25 +12,27 @@ type CalculatorService struct {
 	proto.UnimplementedCalculatorServer
 }
 
-func (s *CalculatorService) Add(ctx context.Context, req *proto.AddRequest) *proto.AddResponse {
+func (s *CalculatorService) Add(ctx context.Context, req *proto.AddRequest) (*proto.AddResponse, error) {
 	// TODO: Implement your logic here
 	return &proto.AddResponse{
 		Result: req.A + req.B,
-	}
+	}, nil
 }
 
-func (s *CalculatorService) Multiply(ctx context.Context, req *proto.MultiplyRequest) *proto.MultiplyResponse {
+func (s *CalculatorService) Multiply(ctx context.Context, req *proto.MultiplyRequest) (*proto.MultiplyResponse, error) {
 	// TODO: Implement your logic here
 	return &proto.MultiplyResponse{
 		Result: req.A * req.B,
-	}
+	}, nil
 }
 
-func (s *CalculatorService) Divide(ctx context.Context, req *proto.DivideRequest) *proto.DivideResponse {
-	// TODO: Implement your logic here
+func (s *CalculatorService) Divide(ctx context.Context, req *proto.DivideRequest) (*proto.DivideResponse, error) {
+	if req.B == 0 {
+		return nil, status.Errorf(status.InvalidArgument, "division by zero")
+	}
 	return &proto.DivideResponse{
 		Result: req.A / req.B,
-	}
+	}, nil
 }
 
 
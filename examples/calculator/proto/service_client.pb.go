@@ -2,40 +2,40 @@
 package proto
 
 import (
+	"context"
+
 	rpc "github.com/jibuji/go-stream-rpc/rpc"
 )
 
 type CalculatorClient struct {
-	peer *rpc.RpcPeer
+	cc rpc.ClientConnInterface
 }
 
-func NewCalculatorClient(peer *rpc.RpcPeer) *CalculatorClient {
-	return &CalculatorClient{peer: peer}
+// NewCalculatorClient returns a client calling through a peer or a client connection.
+func NewCalculatorClient(cc rpc.ClientConnInterface) *CalculatorClient {
+	return &CalculatorClient{cc: cc}
 }
 
-func (c *CalculatorClient) Add(req *AddRequest) *AddResponse {
+func (c *CalculatorClient) Add(ctx context.Context, req *AddRequest, opts ...rpc.CallOption) (*AddResponse, error) {
 	resp := &AddResponse{}
-	err := c.peer.Call("Calculator.Add", req, resp)
-	if err != nil {
-		return nil
+	if err := c.cc.CallContext(ctx, "Calculator.Add", req, resp, opts...); err != nil {
+		return nil, err
 	}
-	return resp
+	return resp, nil
 }
 
-func (c *CalculatorClient) Multiply(req *MultiplyRequest) *MultiplyResponse {
+func (c *CalculatorClient) Multiply(ctx context.Context, req *MultiplyRequest, opts ...rpc.CallOption) (*MultiplyResponse, error) {
 	resp := &MultiplyResponse{}
-	err := c.peer.Call("Calculator.Multiply", req, resp)
-	if err != nil {
-		return nil
+	if err := c.cc.CallContext(ctx, "Calculator.Multiply", req, resp, opts...); err != nil {
+		return nil, err
 	}
-	return resp
+	return resp, nil
 }
 
-func (c *CalculatorClient) Divide(req *DivideRequest) *DivideResponse {
+func (c *CalculatorClient) Divide(ctx context.Context, req *DivideRequest, opts ...rpc.CallOption) (*DivideResponse, error) {
 	resp := &DivideResponse{}
-	err := c.peer.Call("Calculator.Divide", req, resp)
-	if err != nil {
-		return nil
+	if err := c.cc.CallContext(ctx, "Calculator.Divide", req, resp, opts...); err != nil {
+		return nil, err
 	}
-	return resp
+	return resp, nil
 }
@@ -10,42 +10,91 @@ import (
 type UnimplementedCalculatorServer struct{}
 
 type CalculatorServer interface {
-	Add(context.Context, *AddRequest) *AddResponse
+	Add(context.Context, *AddRequest) (*AddResponse, error)
 
-	Multiply(context.Context, *MultiplyRequest) *MultiplyResponse
+	Multiply(context.Context, *MultiplyRequest) (*MultiplyResponse, error)
 
-	Divide(context.Context, *DivideRequest) *DivideResponse
+	Divide(context.Context, *DivideRequest) (*DivideResponse, error)
 }
 
-type CalculatorServerImpl struct {
-	impl CalculatorServer
+// RegisterCalculatorServer registers impl with a peer or a server.
+func RegisterCalculatorServer(s rpc.ServiceRegistrar, impl CalculatorServer) {
+	s.RegisterServiceDesc(&Calculator_ServiceDesc, impl)
 }
 
-func RegisterCalculatorServer(peer *rpc.RpcPeer, impl CalculatorServer) {
-	server := &CalculatorServerImpl{impl: impl}
-	peer.RegisterService("Calculator", server)
+// Calculator_ServiceDesc describes the Calculator service for rpc.ServiceRegistrar.RegisterServiceDesc.
+var Calculator_ServiceDesc = rpc.ServiceDesc{
+	ServiceName: "Calculator",
+	HandlerType: (*CalculatorServer)(nil),
+	Methods: map[string]rpc.MethodDesc{
+		"Add":      {Handler: _Calculator_Add_Handler},
+		"Multiply": {Handler: _Calculator_Multiply_Handler},
+		"Divide":   {Handler: _Calculator_Divide_Handler},
+	},
 }
 
-func (s *UnimplementedCalculatorServer) Add(ctx context.Context, req *AddRequest) *AddResponse {
-	return nil
+func (s *UnimplementedCalculatorServer) Add(ctx context.Context, req *AddRequest) (*AddResponse, error) {
+	return nil, rpc.ErrNotImplemented
 }
 
-func (s *UnimplementedCalculatorServer) Multiply(ctx context.Context, req *MultiplyRequest) *MultiplyResponse {
-	return nil
+func (s *UnimplementedCalculatorServer) Multiply(ctx context.Context, req *MultiplyRequest) (*MultiplyResponse, error) {
+	return nil, rpc.ErrNotImplemented
 }
 
-func (s *UnimplementedCalculatorServer) Divide(ctx context.Context, req *DivideRequest) *DivideResponse {
-	return nil
+func (s *UnimplementedCalculatorServer) Divide(ctx context.Context, req *DivideRequest) (*DivideResponse, error) {
+	return nil, rpc.ErrNotImplemented
 }
 
-func (s *CalculatorServerImpl) Add(ctx context.Context, req *AddRequest) *AddResponse {
-	return s.impl.Add(ctx, req)
+func _Calculator_Add_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor rpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &AddRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).Add(ctx, req)
+	}
+	info := &rpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "Calculator.Add",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).Add(ctx, req.(*AddRequest))
+	}
+	return interceptor(ctx, req, info, handler)
 }
 
-func (s *CalculatorServerImpl) Multiply(ctx context.Context, req *MultiplyRequest) *MultiplyResponse {
-	return s.impl.Multiply(ctx, req)
+func _Calculator_Multiply_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor rpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &MultiplyRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).Multiply(ctx, req)
+	}
+	info := &rpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "Calculator.Multiply",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).Multiply(ctx, req.(*MultiplyRequest))
+	}
+	return interceptor(ctx, req, info, handler)
 }
 
-func (s *CalculatorServerImpl) Divide(ctx context.Context, req *DivideRequest) *DivideResponse {
-	return s.impl.Divide(ctx, req)
+func _Calculator_Divide_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor rpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &DivideRequest{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServer).Divide(ctx, req)
+	}
+	info := &rpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "Calculator.Divide",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServer).Divide(ctx, req.(*DivideRequest))
+	}
+	return interceptor(ctx, req, info, handler)
 }
@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.17.6
 	github.com/libp2p/go-libp2p v0.33.1
 	github.com/multiformats/go-multiaddr v0.12.2
 	google.golang.org/protobuf v1.32.0
@@ -31,7 +32,6 @@ require (
 	github.com/ipfs/go-log/v2 v2.5.1 // indirect
 	github.com/jackpal/go-nat-pmp v1.0.2 // indirect
 	github.com/jbenet/go-temp-err-catcher v0.1.0 // indirect
-	github.com/klauspost/compress v1.17.6 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.7 // indirect
 	github.com/koron/go-ssdp v0.0.4 // indirect
 	github.com/libp2p/go-buffer-pool v0.1.0 // indirect
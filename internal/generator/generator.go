@@ -3,12 +3,16 @@ package generator
 import (
 	"bytes"
 	"io"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Method struct {
-	Name       string
-	InputType  string
-	OutputType string
+	Name            string
+	InputType       string
+	OutputType      string
+	ClientStreaming bool
+	ServerStreaming bool
 }
 
 type TemplateData struct {
@@ -16,10 +20,39 @@ type TemplateData struct {
 	ProtoPackage string
 	ServiceName  string
 	Methods      []Method
+
+	// LegacyClient generates unary client methods with the old
+	// Method(req) *Resp signature, which reports every error as a nil
+	// response. It only exists to ease migration.
+	LegacyClient bool
+}
+
+// HasStreaming reports whether any method of the service streams its
+// requests or responses.
+func (d TemplateData) HasStreaming() bool {
+	for _, m := range d.Methods {
+		if m.ClientStreaming || m.ServerStreaming {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientNeedsContext reports whether the generated client imports the
+// context package.
+func (d TemplateData) ClientNeedsContext() bool {
+	return d.HasStreaming() || !d.LegacyClient
+}
+
+// LowerServiceName returns the service name with its first letter lowercased,
+// for naming unexported helper types.
+func (d TemplateData) LowerServiceName() string {
+	r, size := utf8.DecodeRuneInString(d.ServiceName)
+	return string(unicode.ToLower(r)) + d.ServiceName[size:]
 }
 
 func (m Method) Signature() string {
-	return "(" + "ctx context.Context, req *" + m.InputType + ") *" + m.OutputType
+	return "(" + "ctx context.Context, req *" + m.InputType + ") (*" + m.OutputType + ", error)"
 }
 
 func (m Method) CallSignature() string {
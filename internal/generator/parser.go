@@ -78,8 +78,8 @@ func ParseExistingService(filePath string) (map[string]*ExistingMethod, error) {
 					}
 				}
 
-				// Parse result
-				if funcDecl.Type.Results != nil && len(funcDecl.Type.Results.List) == 1 {
+				// Parse result; the response comes first, optionally followed by an error
+				if funcDecl.Type.Results != nil && len(funcDecl.Type.Results.List) >= 1 {
 					result := funcDecl.Type.Results.List[0]
 					if star, ok := result.Type.(*ast.StarExpr); ok {
 						if sel, ok := star.X.(*ast.SelectorExpr); ok {
@@ -11,26 +11,148 @@ var clientStubTemplate = template.Must(template.New("client").Parse(`
 package {{.PackageName}}
 
 import (
+	{{- if .ClientNeedsContext}}
+	"context"
+	{{end}}
 	rpc "github.com/jibuji/go-stream-rpc/rpc"
 )
 
 type {{.ServiceName}}Client struct {
-	peer *rpc.RpcPeer
+	cc rpc.ClientConnInterface
 }
 
-func New{{.ServiceName}}Client(peer *rpc.RpcPeer) *{{.ServiceName}}Client {
-	return &{{.ServiceName}}Client{peer: peer}
+// New{{.ServiceName}}Client returns a client calling through a peer or a client connection.
+func New{{.ServiceName}}Client(cc rpc.ClientConnInterface) *{{.ServiceName}}Client {
+	return &{{.ServiceName}}Client{cc: cc}
 }
 
 {{range .Methods}}
+{{- if and .ClientStreaming .ServerStreaming}}
+func (c *{{$.ServiceName}}Client) {{.Name}}(ctx context.Context, opts ...rpc.CallOption) ({{$.ServiceName}}_{{.Name}}Client, error) {
+	stream, err := c.cc.OpenStream(ctx, "{{$.ServiceName}}.{{.Name}}", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &{{$.LowerServiceName}}{{.Name}}Client{stream}, nil
+}
+
+// {{$.ServiceName}}_{{.Name}}Client exchanges the messages of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Client interface {
+	Send(*{{.InputType}}) error
+	Recv() (*{{.OutputType}}, error)
+	CloseSend() error
+	Context() context.Context
+}
+
+type {{$.LowerServiceName}}{{.Name}}Client struct {
+	stream rpc.BidiStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Send(m *{{.InputType}}) error {
+	return x.stream.Send(m)
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Recv() (*{{.OutputType}}, error) {
+	m := &{{.OutputType}}{}
+	if err := x.stream.Recv(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) CloseSend() error {
+	return x.stream.CloseSend()
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Context() context.Context {
+	return x.stream.Context()
+}
+{{else if .ClientStreaming}}
+func (c *{{$.ServiceName}}Client) {{.Name}}(ctx context.Context, opts ...rpc.CallOption) ({{$.ServiceName}}_{{.Name}}Client, error) {
+	stream, err := c.cc.OpenStream(ctx, "{{$.ServiceName}}.{{.Name}}", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &{{$.LowerServiceName}}{{.Name}}Client{stream}, nil
+}
+
+// {{$.ServiceName}}_{{.Name}}Client sends the requests of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Client interface {
+	Send(*{{.InputType}}) error
+	CloseAndRecv() (*{{.OutputType}}, error)
+	Context() context.Context
+}
+
+type {{$.LowerServiceName}}{{.Name}}Client struct {
+	stream rpc.BidiStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Send(m *{{.InputType}}) error {
+	return x.stream.Send(m)
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) CloseAndRecv() (*{{.OutputType}}, error) {
+	if err := x.stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := &{{.OutputType}}{}
+	if err := x.stream.Recv(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Context() context.Context {
+	return x.stream.Context()
+}
+{{else if .ServerStreaming}}
+func (c *{{$.ServiceName}}Client) {{.Name}}(ctx context.Context, req *{{.InputType}}, opts ...rpc.CallOption) ({{$.ServiceName}}_{{.Name}}Client, error) {
+	stream, err := c.cc.CallStream(ctx, "{{$.ServiceName}}.{{.Name}}", req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &{{$.LowerServiceName}}{{.Name}}Client{stream}, nil
+}
+
+// {{$.ServiceName}}_{{.Name}}Client receives the responses of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Client interface {
+	Recv() (*{{.OutputType}}, error)
+	Context() context.Context
+}
+
+type {{$.LowerServiceName}}{{.Name}}Client struct {
+	stream rpc.ClientStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Recv() (*{{.OutputType}}, error) {
+	m := &{{.OutputType}}{}
+	if err := x.stream.Recv(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Client) Context() context.Context {
+	return x.stream.Context()
+}
+{{else if $.LegacyClient}}
 func (c *{{$.ServiceName}}Client) {{.Name}}(req *{{.InputType}}) *{{.OutputType}} {
 	resp := &{{.OutputType}}{}
-	err := c.peer.Call("{{$.ServiceName}}.{{.Name}}", req, resp)
+	err := c.cc.Call("{{$.ServiceName}}.{{.Name}}", req, resp)
 	if err != nil {
 		return nil
 	}
 	return resp
 }
+{{else}}
+func (c *{{$.ServiceName}}Client) {{.Name}}(ctx context.Context, req *{{.InputType}}, opts ...rpc.CallOption) (*{{.OutputType}}, error) {
+	resp := &{{.OutputType}}{}
+	if err := c.cc.CallContext(ctx, "{{$.ServiceName}}.{{.Name}}", req, resp, opts...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+{{end}}
 {{end}}
 `))
 
@@ -48,29 +170,169 @@ type Unimplemented{{.ServiceName}}Server struct {}
 
 type {{.ServiceName}}Server interface {
 	{{range .Methods}}
-	{{.Name}}(context.Context, *{{.InputType}}) (*{{.OutputType}})
+	{{- if and .ClientStreaming .ServerStreaming}}
+	{{.Name}}(context.Context, {{$.ServiceName}}_{{.Name}}Server) error
+	{{else if .ClientStreaming}}
+	{{.Name}}(context.Context, {{$.ServiceName}}_{{.Name}}Server) (*{{.OutputType}}, error)
+	{{else if .ServerStreaming}}
+	{{.Name}}(context.Context, *{{.InputType}}, {{$.ServiceName}}_{{.Name}}Server) error
+	{{else}}
+	{{.Name}}(context.Context, *{{.InputType}}) (*{{.OutputType}}, error)
+	{{end}}
 	{{end}}
 }
 
-type {{.ServiceName}}ServerImpl struct {
-	impl {{.ServiceName}}Server
+// Register{{.ServiceName}}Server registers impl with a peer or a server.
+func Register{{.ServiceName}}Server(s rpc.ServiceRegistrar, impl {{.ServiceName}}Server) {
+	s.RegisterServiceDesc(&{{.ServiceName}}_ServiceDesc, impl)
 }
 
-func Register{{.ServiceName}}Server(peer *rpc.RpcPeer, impl {{.ServiceName}}Server) {
-	server := &{{.ServiceName}}ServerImpl{impl: impl}
-	peer.RegisterService("{{.ServiceName}}", server)
+// {{.ServiceName}}_ServiceDesc describes the {{.ServiceName}} service for rpc.ServiceRegistrar.RegisterServiceDesc.
+var {{.ServiceName}}_ServiceDesc = rpc.ServiceDesc{
+	ServiceName: "{{.ServiceName}}",
+	HandlerType: (*{{.ServiceName}}Server)(nil),
+	Methods: map[string]rpc.MethodDesc{
+		{{- range .Methods}}
+		{{- if or .ClientStreaming .ServerStreaming}}
+		"{{.Name}}": {
+			ClientStreams: {{.ClientStreaming}},
+			ServerStreams: {{.ServerStreaming}},
+			StreamHandler: _{{$.ServiceName}}_{{.Name}}_Handler,
+		},
+		{{- else}}
+		"{{.Name}}": {Handler: _{{$.ServiceName}}_{{.Name}}_Handler},
+		{{- end}}
+		{{- end}}
+	},
 }
 
 {{range .Methods}}
-func (s *Unimplemented{{$.ServiceName}}Server) {{.Name}}(ctx context.Context, req *{{.InputType}}) (*{{.OutputType}}) {
-	return nil
+{{- if and .ClientStreaming .ServerStreaming}}
+func (s *Unimplemented{{$.ServiceName}}Server) {{.Name}}(ctx context.Context, stream {{$.ServiceName}}_{{.Name}}Server) error {
+	return rpc.ErrNotImplemented
+}
+{{else if .ClientStreaming}}
+func (s *Unimplemented{{$.ServiceName}}Server) {{.Name}}(ctx context.Context, stream {{$.ServiceName}}_{{.Name}}Server) (*{{.OutputType}}, error) {
+	return nil, rpc.ErrNotImplemented
+}
+{{else if .ServerStreaming}}
+func (s *Unimplemented{{$.ServiceName}}Server) {{.Name}}(ctx context.Context, req *{{.InputType}}, stream {{$.ServiceName}}_{{.Name}}Server) error {
+	return rpc.ErrNotImplemented
+}
+{{else}}
+func (s *Unimplemented{{$.ServiceName}}Server) {{.Name}}(ctx context.Context, req *{{.InputType}}) (*{{.OutputType}}, error) {
+	return nil, rpc.ErrNotImplemented
 }
 {{end}}
+{{end}}
 
 {{range .Methods}}
-func (s *{{$.ServiceName}}ServerImpl) {{.Name}}(ctx context.Context, req *{{.InputType}}) (*{{.OutputType}}) {
-	return s.impl.{{.Name}}(ctx, req)
+{{- if and .ClientStreaming .ServerStreaming}}
+func _{{$.ServiceName}}_{{.Name}}_Handler(srv interface{}, stream rpc.BidiStream) error {
+	return srv.({{$.ServiceName}}Server).{{.Name}}(stream.Context(), &{{$.LowerServiceName}}{{.Name}}Server{stream})
+}
+
+// {{$.ServiceName}}_{{.Name}}Server exchanges the messages of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Server interface {
+	Send(*{{.OutputType}}) error
+	Recv() (*{{.InputType}}, error)
+	Context() context.Context
 }
+
+type {{$.LowerServiceName}}{{.Name}}Server struct {
+	stream rpc.BidiStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Send(m *{{.OutputType}}) error {
+	return x.stream.Send(m)
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Recv() (*{{.InputType}}, error) {
+	m := &{{.InputType}}{}
+	if err := x.stream.Recv(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Context() context.Context {
+	return x.stream.Context()
+}
+{{else if .ClientStreaming}}
+func _{{$.ServiceName}}_{{.Name}}_Handler(srv interface{}, stream rpc.BidiStream) error {
+	resp, err := srv.({{$.ServiceName}}Server).{{.Name}}(stream.Context(), &{{$.LowerServiceName}}{{.Name}}Server{stream})
+	if err != nil {
+		return err
+	}
+	return stream.Send(resp)
+}
+
+// {{$.ServiceName}}_{{.Name}}Server receives the requests of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Server interface {
+	Recv() (*{{.InputType}}, error)
+	Context() context.Context
+}
+
+type {{$.LowerServiceName}}{{.Name}}Server struct {
+	stream rpc.BidiStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Recv() (*{{.InputType}}, error) {
+	m := &{{.InputType}}{}
+	if err := x.stream.Recv(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Context() context.Context {
+	return x.stream.Context()
+}
+{{else if .ServerStreaming}}
+func _{{$.ServiceName}}_{{.Name}}_Handler(srv interface{}, stream rpc.BidiStream) error {
+	req := &{{.InputType}}{}
+	if err := stream.Recv(req); err != nil {
+		return err
+	}
+	return srv.({{$.ServiceName}}Server).{{.Name}}(stream.Context(), req, &{{$.LowerServiceName}}{{.Name}}Server{stream})
+}
+
+// {{$.ServiceName}}_{{.Name}}Server sends the responses of {{$.ServiceName}}.{{.Name}}.
+type {{$.ServiceName}}_{{.Name}}Server interface {
+	Send(*{{.OutputType}}) error
+	Context() context.Context
+}
+
+type {{$.LowerServiceName}}{{.Name}}Server struct {
+	stream rpc.ServerStream
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Send(m *{{.OutputType}}) error {
+	return x.stream.Send(m)
+}
+
+func (x *{{$.LowerServiceName}}{{.Name}}Server) Context() context.Context {
+	return x.stream.Context()
+}
+{{else}}
+func _{{$.ServiceName}}_{{.Name}}_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor rpc.UnaryServerInterceptor) (interface{}, error) {
+	req := &{{.InputType}}{}
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.({{$.ServiceName}}Server).{{.Name}}(ctx, req)
+	}
+	info := &rpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "{{$.ServiceName}}.{{.Name}}",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.({{$.ServiceName}}Server).{{.Name}}(ctx, req.(*{{.InputType}}))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+{{end}}
 {{end}}
 `))
 
@@ -90,18 +352,52 @@ type {{.ServiceName}}Service struct {
 
 {{range .Methods}}
 // {{.Name}} implements {{$.ServiceName}}Server
-func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}) *proto.{{.OutputType}} {
+{{- if and .ClientStreaming .ServerStreaming}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, stream proto.{{$.ServiceName}}_{{.Name}}Server) error {
+	// TODO: Implement your logic here
+	return nil
+}
+{{- else if .ClientStreaming}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, stream proto.{{$.ServiceName}}_{{.Name}}Server) (*proto.{{.OutputType}}, error) {
 	// TODO: Implement your logic here
-	return &proto.{{.OutputType}}{}
+	return &proto.{{.OutputType}}{}, nil
 }
+{{- else if .ServerStreaming}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}, stream proto.{{$.ServiceName}}_{{.Name}}Server) error {
+	// TODO: Implement your logic here
+	return nil
+}
+{{- else}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}) (*proto.{{.OutputType}}, error) {
+	// TODO: Implement your logic here
+	return &proto.{{.OutputType}}{}, nil
+}
+{{- end}}
 {{end}}
 `))
 
-var methodTemplate = template.Must(template.New("method").Parse(`func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}) *proto.{{.OutputType}} {
+var methodTemplate = template.Must(template.New("method").Parse(`
+{{- if and .ClientStreaming .ServerStreaming -}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, stream proto.{{$.ServiceName}}_{{.Name}}Server) error {
 	// TODO: Implement your logic here
-	return &proto.{{.OutputType}}{}
+	return nil
 }
-`))
+{{else if .ClientStreaming -}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, stream proto.{{$.ServiceName}}_{{.Name}}Server) (*proto.{{.OutputType}}, error) {
+	// TODO: Implement your logic here
+	return &proto.{{.OutputType}}{}, nil
+}
+{{else if .ServerStreaming -}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}, stream proto.{{$.ServiceName}}_{{.Name}}Server) error {
+	// TODO: Implement your logic here
+	return nil
+}
+{{else -}}
+func (s *{{$.ServiceName}}Service) {{.Name}}(ctx context.Context, req *proto.{{.InputType}}) (*proto.{{.OutputType}}, error) {
+	// TODO: Implement your logic here
+	return &proto.{{.OutputType}}{}, nil
+}
+{{end}}`))
 
 func GenerateSkeleton(w io.Writer, data TemplateData, _ map[string]*ExistingMethod) error {
 	var buf bytes.Buffer
@@ -0,0 +1,380 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// DefaultEjectionTime is how long a Balancer leaves a backend out after a call
+// on it failed with a transport error.
+const DefaultEjectionTime = 30 * time.Second
+
+// Backend is a remote end a Balancer sends calls to.
+type Backend struct {
+	name         string
+	conn         ClientConnInterface
+	inFlight     atomic.Int64
+	ejectedUntil atomic.Int64 // Unix nanoseconds, 0 if never ejected
+}
+
+// Name returns the name the backend was added with.
+func (be *Backend) Name() string {
+	return be.name
+}
+
+// InFlight returns the number of calls on the backend that have not
+// finished yet.
+func (be *Backend) InFlight() int {
+	return int(be.inFlight.Load())
+}
+
+// Healthy reports whether the backend is in rotation, i.e. not ejected after
+// a transport error.
+func (be *Backend) Healthy() bool {
+	return time.Now().UnixNano() >= be.ejectedUntil.Load()
+}
+
+// BalancerPolicy chooses the backend of each call made through a Balancer.
+type BalancerPolicy interface {
+	// Pick returns one of backends, which is never empty, for a call whose
+	// balance key, set with BalanceKey, is key.
+	Pick(key string, backends []*Backend) *Backend
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+// RoundRobin returns a policy sending calls to the backends in turn.
+func RoundRobin() BalancerPolicy {
+	return &roundRobin{}
+}
+
+func (p *roundRobin) Pick(key string, backends []*Backend) *Backend {
+	return backends[(p.next.Add(1)-1)%uint64(len(backends))]
+}
+
+type leastInFlight struct{}
+
+// LeastInFlight returns a policy sending each call to the backend with the
+// fewest calls in flight.
+func LeastInFlight() BalancerPolicy {
+	return leastInFlight{}
+}
+
+func (leastInFlight) Pick(key string, backends []*Backend) *Backend {
+	// Start at a random backend so that ties are spread out.
+	start := rand.Intn(len(backends))
+	best := backends[start]
+	for i := 1; i < len(backends); i++ {
+		if be := backends[(start+i)%len(backends)]; be.InFlight() < best.InFlight() {
+			best = be
+		}
+	}
+	return best
+}
+
+type powerOfTwoChoices struct{}
+
+// PowerOfTwoChoices returns a policy sending each call to the less loaded of
+// two backends chosen at random, which comes close to LeastInFlight without
+// looking at every backend.
+func PowerOfTwoChoices() BalancerPolicy {
+	return powerOfTwoChoices{}
+}
+
+func (powerOfTwoChoices) Pick(key string, backends []*Backend) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.Intn(len(backends))
+	j := rand.Intn(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+	if backends[j].InFlight() < backends[i].InFlight() {
+		return backends[j]
+	}
+	return backends[i]
+}
+
+type consistentHash struct{}
+
+// ConsistentHash returns a policy sending all calls with the same balance key
+// to the same backend, using rendezvous hashing of the key and the backend
+// names: adding or removing a backend only moves the keys that belong to it.
+// Calls without a key go to a random backend.
+func ConsistentHash() BalancerPolicy {
+	return consistentHash{}
+}
+
+func (consistentHash) Pick(key string, backends []*Backend) *Backend {
+	if key == "" {
+		return backends[rand.Intn(len(backends))]
+	}
+
+	var best *Backend
+	var bestScore uint64
+	for _, be := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(be.name))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = be, score
+		}
+	}
+	return best
+}
+
+// BalanceKey sets the key a ConsistentHash policy maps the call by. It has
+// no effect on calls that are not made through a Balancer.
+func BalanceKey(key string) CallOption {
+	return func(o *callOptions) {
+		o.balanceKey = key
+	}
+}
+
+// Balancer spreads calls over several backends, each a peer or a client
+// connection to one replica of the same services, according to a policy.
+// Generated clients can call through a Balancer like through a single peer.
+//
+// A backend on which a call fails with a transport error, such as a lost
+// connection, is left out for the ejection time. If every backend is ejected,
+// calls are spread over all of them.
+type Balancer struct {
+	policy       BalancerPolicy
+	ejectionTime time.Duration
+
+	mu       sync.Mutex
+	backends []*Backend // replaced, never modified, so it can be read without mu
+}
+
+type BalancerOption func(*Balancer)
+
+// WithEjectionTime sets how long a backend is left out after a transport
+// error.
+func WithEjectionTime(d time.Duration) BalancerOption {
+	return func(b *Balancer) {
+		b.ejectionTime = d
+	}
+}
+
+// NewBalancer creates a Balancer without backends that picks them with
+// policy.
+func NewBalancer(policy BalancerPolicy, opts ...BalancerOption) *Balancer {
+	b := &Balancer{
+		policy:       policy,
+		ejectionTime: DefaultEjectionTime,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Add adds conn as a backend called name, replacing the backend of the same
+// name if there is one.
+func (b *Balancer) Add(name string, conn ClientConnInterface) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backends := make([]*Backend, 0, len(b.backends)+1)
+	for _, be := range b.backends {
+		if be.name != name {
+			backends = append(backends, be)
+		}
+	}
+	b.backends = append(backends, &Backend{name: name, conn: conn})
+}
+
+// Remove removes the backend called name and returns its connection, so the
+// caller can close it once its calls have finished.
+func (b *Balancer) Remove(name string) (ClientConnInterface, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, be := range b.backends {
+		if be.name == name {
+			backends := make([]*Backend, 0, len(b.backends)-1)
+			backends = append(backends, b.backends[:i]...)
+			b.backends = append(backends, b.backends[i+1:]...)
+			return be.conn, true
+		}
+	}
+	return nil, false
+}
+
+// Backends returns the backends of the Balancer. The slice must not be
+// modified.
+func (b *Balancer) Backends() []*Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.backends
+}
+
+// pick chooses the backend of a call and counts the call in flight on it.
+func (b *Balancer) pick(opts []CallOption) (*Backend, error) {
+	all := b.Backends()
+	if len(all) == 0 {
+		return nil, status.Errorf(status.Unavailable, "no backends")
+	}
+
+	healthy := make([]*Backend, 0, len(all))
+	for _, be := range all {
+		if be.Healthy() {
+			healthy = append(healthy, be)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = all
+	}
+
+	be := b.policy.Pick(newCallOptions(opts).balanceKey, healthy)
+	be.inFlight.Add(1)
+	return be, nil
+}
+
+// done ends a call on be that finished with err.
+func (b *Balancer) done(be *Backend, err error) {
+	be.inFlight.Add(-1)
+	b.report(be, err)
+}
+
+// report ejects be for the ejection time if err means that its connection,
+// rather than the call, failed.
+func (b *Balancer) report(be *Backend, err error) {
+	if isTransportError(err) {
+		be.ejectedUntil.Store(time.Now().Add(b.ejectionTime).UnixNano())
+	}
+}
+
+// isTransportError reports whether err means the connection to a backend,
+// rather than the call, failed. Only errors of the framework count: an
+// Unavailable status returned by a handler says nothing about the connection.
+func isTransportError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The caller gave up; context.DeadlineExceeded is a net.Error too.
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrPeerClosed) ||
+		errors.Is(err, ErrClientConnClosed) ||
+		errors.Is(err, errConnectionFailed) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &netErr)
+}
+
+// Call invokes methodName like RpcPeer.Call on the backend chosen by the
+// policy.
+func (b *Balancer) Call(methodName string, request, response interface{}) error {
+	be, err := b.pick(nil)
+	if err != nil {
+		return err
+	}
+	err = be.conn.Call(methodName, request, response)
+	b.done(be, err)
+	return err
+}
+
+// CallContext invokes methodName like RpcPeer.CallContext on the backend
+// chosen by the policy.
+func (b *Balancer) CallContext(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error {
+	be, err := b.pick(opts)
+	if err != nil {
+		return err
+	}
+	err = be.conn.CallContext(ctx, methodName, request, response, opts...)
+	b.done(be, err)
+	return err
+}
+
+// CallStream starts a server-streaming call like RpcPeer.CallStream on the
+// backend chosen by the policy. The call counts as in flight until it is
+// over: until Recv returns an error, io.EOF included, or the context of the
+// stream is done.
+func (b *Balancer) CallStream(ctx context.Context, methodName string, request interface{}, opts ...CallOption) (ClientStream, error) {
+	be, err := b.pick(opts)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := be.conn.CallStream(ctx, methodName, request, opts...)
+	if err != nil {
+		b.done(be, err)
+		return nil, err
+	}
+	return &balancedClientStream{ClientStream: stream, finish: b.finisher(stream.Context(), be)}, nil
+}
+
+// OpenStream starts a client- or bidi-streaming call like RpcPeer.OpenStream
+// on the backend chosen by the policy. The call counts as in flight until it
+// is over: until Recv returns an error, io.EOF included, or the context of
+// the stream is done. A client-streaming call whose single response has
+// been received is thereby over without a further Recv.
+func (b *Balancer) OpenStream(ctx context.Context, methodName string, opts ...CallOption) (BidiStream, error) {
+	be, err := b.pick(opts)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := be.conn.OpenStream(ctx, methodName, opts...)
+	if err != nil {
+		b.done(be, err)
+		return nil, err
+	}
+	return &balancedBidiStream{BidiStream: stream, finish: b.finisher(stream.Context(), be)}, nil
+}
+
+// finisher returns the function a stream calls with the error Recv failed
+// with. The call on be ends then, or when ctx, the context of the stream, is
+// done, whichever comes first; peers cancel it once the call is over.
+func (b *Balancer) finisher(ctx context.Context, be *Backend) func(error) {
+	var once sync.Once
+	release := func() {
+		once.Do(func() { be.inFlight.Add(-1) })
+	}
+	stop := context.AfterFunc(ctx, release)
+	return func(err error) {
+		stop()
+		release()
+		b.report(be, err)
+	}
+}
+
+// balancedClientStream ends its call on the backend when Recv fails.
+type balancedClientStream struct {
+	ClientStream
+	finish func(error)
+}
+
+func (s *balancedClientStream) Recv(msg interface{}) error {
+	err := s.ClientStream.Recv(msg)
+	if err != nil {
+		s.finish(err)
+	}
+	return err
+}
+
+// balancedBidiStream ends its call on the backend when Recv fails.
+type balancedBidiStream struct {
+	BidiStream
+	finish func(error)
+}
+
+func (s *balancedBidiStream) Recv(msg interface{}) error {
+	err := s.BidiStream.Recv(msg)
+	if err != nil {
+		s.finish(err)
+	}
+	return err
+}
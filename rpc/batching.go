@@ -0,0 +1,182 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultMaxBatchSize is the number of bytes the write loop coalesces
+	// into one write when WithWriteBatching is given no size.
+	DefaultMaxBatchSize = 64 * 1024
+
+	// writeQueueLen is the number of frames that may wait for the write loop
+	// before senders block.
+	writeQueueLen = 256
+)
+
+var errWriterClosed = errors.New("rpc: connection closed")
+
+// WithWriteBatching makes the peer write frames from a dedicated goroutine
+// that coalesces the frames queued by concurrent calls into a single write of
+// at most maxBatchSize bytes, so that many small calls cost few system calls.
+// After taking the first frame of a batch, the loop waits up to flushDelay
+// for more frames; with a zero delay it writes as soon as no more frames are
+// queued, which batches only the frames that piled up during the previous
+// write. A non-positive maxBatchSize selects DefaultMaxBatchSize.
+//
+// A failed write closes the stream, failing all calls in progress.
+func WithWriteBatching(maxBatchSize int, flushDelay time.Duration) RpcPeerOption {
+	return func(p *RpcPeer) {
+		if maxBatchSize <= 0 {
+			maxBatchSize = DefaultMaxBatchSize
+		}
+		p.writeQueue = make(chan *buffer, writeQueueLen)
+		p.maxBatchSize = maxBatchSize
+		p.flushDelay = flushDelay
+	}
+}
+
+// sendFrame writes the frame in buf, or queues it for the write loop when
+// write batching is enabled. It takes ownership of buf. The caller must hold
+// writeMu, so that frames are written in the order they are sent.
+func (p *RpcPeer) sendFrame(buf *buffer) error {
+	if p.writeQueue == nil {
+		_, err := p.Stream.Write(buf.b)
+		buf.free()
+		return err
+	}
+
+	select {
+	case <-p.writeDone:
+		buf.free()
+		return p.writeErr
+	default:
+	}
+
+	select {
+	case p.writeQueue <- buf:
+		return nil
+	case <-p.writeDone:
+		buf.free()
+		return p.writeErr
+	}
+}
+
+// writeLoop writes the queued frames in batches until the peer is closed or
+// a write fails.
+func (p *RpcPeer) writeLoop() {
+	defer close(p.writeDone)
+
+	batch := make([]byte, 0, p.maxBatchSize)
+	for {
+		var flushed chan struct{}
+		select {
+		case buf := <-p.writeQueue:
+			batch, flushed = appendQueued(batch[:0], buf)
+		case <-p.ctx.Done():
+			p.writeErr = errWriterClosed
+			return
+		}
+
+		if flushed == nil {
+			batch, flushed = p.fillBatch(batch)
+		}
+		if len(batch) > 0 {
+			if _, err := p.Stream.Write(batch); err != nil {
+				p.writeErr = err
+				// Let the read loop fail the calls waiting for responses.
+				p.Stream.Close()
+				return
+			}
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+
+		if cap(batch) > 2*p.maxBatchSize {
+			// Don't hold on to the memory of an unusually large frame.
+			batch = make([]byte, 0, p.maxBatchSize)
+		}
+	}
+}
+
+// appendQueued appends the frame in buf to batch and frees buf. If buf is a
+// flush marker instead, batch is returned unchanged along with the channel
+// to close once it is written.
+func appendQueued(batch []byte, buf *buffer) ([]byte, chan struct{}) {
+	if buf.flushed != nil {
+		return batch, buf.flushed
+	}
+	batch = append(batch, buf.b...)
+	buf.free()
+	return batch, nil
+}
+
+// fillBatch appends queued frames to batch until it holds maxBatchSize
+// bytes, no frame is queued and the flush delay has passed, or a flush
+// marker is taken from the queue. It returns the channel of that marker, if
+// any.
+func (p *RpcPeer) fillBatch(batch []byte) ([]byte, chan struct{}) {
+	var flush <-chan time.Time
+	if p.flushDelay > 0 {
+		timer := time.NewTimer(p.flushDelay)
+		defer timer.Stop()
+		flush = timer.C
+	}
+
+	var flushed chan struct{}
+	for len(batch) < p.maxBatchSize {
+		select {
+		case buf := <-p.writeQueue:
+			if batch, flushed = appendQueued(batch, buf); flushed != nil {
+				return batch, flushed
+			}
+			continue
+		default:
+		}
+
+		if flush == nil {
+			return batch, nil
+		}
+		select {
+		case buf := <-p.writeQueue:
+			if batch, flushed = appendQueued(batch, buf); flushed != nil {
+				return batch, flushed
+			}
+		case <-flush:
+			return batch, nil
+		case <-p.ctx.Done():
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// flushWrites waits until the write loop has written the frames queued so
+// far, so that closing the stream does not drop them. It returns at once
+// without write batching.
+func (p *RpcPeer) flushWrites(ctx context.Context) error {
+	if p.writeQueue == nil {
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case p.writeQueue <- &buffer{flushed: flushed}:
+	case <-p.writeDone:
+		return p.writeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-p.writeDone:
+		return p.writeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type benchService struct{}
+
+func (s *benchService) Echo(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	return req, nil
+}
+
+func (s *benchService) Repeat(ctx context.Context, req *wrapperspb.BytesValue, stream ServerStream) error {
+	for i := 0; i < 100; i++ {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newBenchPeers(b *testing.B, opts ...RpcPeerOption) (*RpcPeer, *countingConn) {
+	b.Helper()
+
+	c1, c2 := net.Pipe()
+	clientConn := &countingConn{Conn: c1}
+	client := NewRpcPeer(clientConn, opts...)
+	server := NewRpcPeer(&countingConn{Conn: c2}, opts...)
+	b.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.RegisterService("Bench", &benchService{})
+	return client, clientConn
+}
+
+var benchSizes = []int{16, 1024, 64 * 1024}
+
+func BenchmarkUnaryCall(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			client, conn := newBenchPeers(b)
+			req := wrapperspb.Bytes(bytes.Repeat([]byte{'x'}, size))
+			resp := &wrapperspb.BytesValue{}
+			ctx := context.Background()
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.CallContext(ctx, "Bench.Echo", req, resp); err != nil {
+					b.Fatalf("CallContext failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(conn.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func BenchmarkConcurrentUnaryCall(b *testing.B) {
+	for _, batching := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batching=%v", batching), func(b *testing.B) {
+			var opts []RpcPeerOption
+			if batching {
+				opts = append(opts, WithWriteBatching(0, 0))
+			}
+			client, conn := newBenchPeers(b, opts...)
+			req := wrapperspb.Bytes(bytes.Repeat([]byte{'x'}, 64))
+
+			b.SetParallelism(16)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				resp := &wrapperspb.BytesValue{}
+				for pb.Next() {
+					if err := client.CallContext(context.Background(), "Bench.Echo", req, resp); err != nil {
+						b.Errorf("CallContext failed: %v", err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(conn.writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func BenchmarkServerStream(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			client, _ := newBenchPeers(b)
+			req := wrapperspb.Bytes(bytes.Repeat([]byte{'x'}, size))
+			msg := &wrapperspb.BytesValue{}
+			ctx := context.Background()
+
+			b.SetBytes(int64(100 * size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stream, err := client.CallStream(ctx, "Bench.Repeat", req)
+				if err != nil {
+					b.Fatalf("CallStream failed: %v", err)
+				}
+				for {
+					if err := stream.Recv(msg); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatalf("Recv failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
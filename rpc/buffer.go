@@ -0,0 +1,46 @@
+package rpc
+
+import "sync"
+
+const (
+	// readBufferSize is the size of the buffer frames are read through, so
+	// that small frames cost one read from the stream rather than several.
+	readBufferSize = 32 * 1024
+
+	// maxPooledBufferSize is the capacity above which buffers are left to
+	// the garbage collector instead of being pooled, so that a burst of large
+	// messages does not pin their memory.
+	maxPooledBufferSize = 1024 * 1024
+)
+
+// buffer is a byte slice reused across frames.
+type buffer struct {
+	b []byte
+
+	// flushed is set on the markers flushWrites queues instead of a frame,
+	// which are never pooled.
+	flushed chan struct{}
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(buffer) },
+}
+
+// getBuffer returns a pooled buffer of length n.
+func getBuffer(n int) *buffer {
+	buf := bufferPool.Get().(*buffer)
+	if cap(buf.b) < n {
+		buf.b = make([]byte, n)
+	}
+	buf.b = buf.b[:n]
+	return buf
+}
+
+// free returns buf to the pool. Neither buf nor slices of it may be used
+// afterwards.
+func (buf *buffer) free() {
+	if cap(buf.b) > maxPooledBufferSize {
+		buf.b = nil
+	}
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/jibuji/go-stream-rpc/rpc/metadata"
+)
+
+// CallOption configures a single call made with CallContext, CallStream or
+// OpenStream.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	timeout time.Duration
+	header  *metadata.MD
+	trailer *metadata.MD
+
+	compressor    string
+	compressorSet bool
+	codec         string
+
+	waitForReady bool
+	balanceKey   string
+}
+
+// CallTimeout limits the call to d. It applies in addition to the deadline of
+// the call's context; whichever expires first ends the call.
+func CallTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = d
+	}
+}
+
+// Header stores the header the handler sends in *md. For unary calls it is
+// set when the call returns; for streaming calls once the first message or
+// the end of the stream has been received.
+func Header(md *metadata.MD) CallOption {
+	return func(o *callOptions) {
+		o.header = md
+	}
+}
+
+// Trailer stores the trailer the handler sends in *md. For streaming calls it
+// is set once Recv has returned an error, including io.EOF.
+func Trailer(md *metadata.MD) CallOption {
+	return func(o *callOptions) {
+		o.trailer = md
+	}
+}
+
+// WaitForReady makes a call through a ClientConn wait, until its context is
+// done, for a connection instead of failing with status.Unavailable while
+// connection attempts are failing. It has no effect on calls made directly
+// on an RpcPeer.
+func WaitForReady(wait bool) CallOption {
+	return func(o *callOptions) {
+		o.waitForReady = wait
+	}
+}
+
+func newCallOptions(opts []CallOption) *callOptions {
+	o := &callOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// context derives the context of a call from ctx.
+func (o *callOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// received stores the response metadata carried by f.
+func (o *callOptions) received(f *frame) {
+	if o.header != nil && f.header != nil {
+		*o.header = f.header
+	}
+	if o.trailer != nil && f.trailer != nil {
+		*o.trailer = f.trailer
+	}
+}
@@ -0,0 +1,465 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+	libp2pstream "github.com/jibuji/go-stream-rpc/stream/libp2p"
+	"github.com/jibuji/go-stream-rpc/stream/tcp"
+)
+
+// ClientConnInterface is implemented by RpcPeer, ClientConn and Balancer,
+// which all make calls. Generated clients take a ClientConnInterface.
+type ClientConnInterface interface {
+	Call(methodName string, request, response interface{}) error
+	CallContext(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error
+	CallStream(ctx context.Context, methodName string, request interface{}, opts ...CallOption) (ClientStream, error)
+	OpenStream(ctx context.Context, methodName string, opts ...CallOption) (BidiStream, error)
+}
+
+// ErrClientConnClosed is returned by calls on a ClientConn after Close.
+var ErrClientConnClosed = status.Errorf(status.Canceled, "rpc: client connection closed")
+
+// errConnectionFailed is wrapped by the errors of calls that fail fast while
+// a ClientConn cannot connect.
+var errConnectionFailed = status.Errorf(status.Unavailable, "connection failed")
+
+// DefaultConnectTimeout is how long a ClientConn waits for a connection
+// attempt, dialing and handshake included, to succeed.
+const DefaultConnectTimeout = 20 * time.Second
+
+// ConnectivityState is the state of a ClientConn.
+type ConnectivityState int
+
+const (
+	// Idle means the ClientConn has not started connecting yet. It connects
+	// on the first call or on Connect.
+	Idle ConnectivityState = iota
+	// Connecting means a connection attempt is in progress.
+	Connecting
+	// Ready means the ClientConn is connected and calls are sent right away.
+	Ready
+	// TransientFailure means the last connection attempt failed and the
+	// ClientConn is waiting to try again.
+	TransientFailure
+	// Shutdown means the ClientConn was closed.
+	Shutdown
+)
+
+func (s ConnectivityState) String() string {
+	switch s {
+	case Idle:
+		return "IDLE"
+	case Connecting:
+		return "CONNECTING"
+	case Ready:
+		return "READY"
+	case TransientFailure:
+		return "TRANSIENT_FAILURE"
+	case Shutdown:
+		return "SHUTDOWN"
+	default:
+		return "INVALID_STATE"
+	}
+}
+
+// DialFunc opens a new connection to the remote end. ctx bounds the
+// connection attempt.
+type DialFunc func(ctx context.Context) (Stream, error)
+
+// TCPDialer returns a DialFunc connecting to addr over TCP.
+func TCPDialer(addr string) DialFunc {
+	return func(ctx context.Context) (Stream, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return tcp.NewTCPStream(conn), nil
+	}
+}
+
+// Libp2pDialer returns a DialFunc opening a stream with protocolID to the
+// peer id through h.
+func Libp2pDialer(h host.Host, id peer.ID, protocolID protocol.ID) DialFunc {
+	return func(ctx context.Context) (Stream, error) {
+		s, err := h.NewStream(ctx, id, protocolID)
+		if err != nil {
+			return nil, err
+		}
+		return libp2pstream.NewLibP2PStream(s), nil
+	}
+}
+
+// BackoffConfig controls the delay between failed connection attempts. The
+// n-th retry waits BaseDelay * Multiplier^n, at most MaxDelay, randomized by
+// up to Jitter times the delay in either direction.
+type BackoffConfig struct {
+	BaseDelay  time.Duration
+	Multiplier float64
+	Jitter     float64
+	MaxDelay   time.Duration
+}
+
+// DefaultBackoffConfig is the backoff a ClientConn uses unless configured
+// otherwise with WithBackoff.
+var DefaultBackoffConfig = BackoffConfig{
+	BaseDelay:  time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   120 * time.Second,
+}
+
+// delay returns the delay before the retry following retries failed ones.
+func (bc BackoffConfig) delay(retries int) time.Duration {
+	backoff, max := float64(bc.BaseDelay), float64(bc.MaxDelay)
+	for ; backoff < max && retries > 0; retries-- {
+		backoff *= bc.Multiplier
+	}
+	if backoff > max {
+		backoff = max
+	}
+	backoff *= 1 + bc.Jitter*(rand.Float64()*2-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
+
+// ClientConn is a connection to a remote end that survives the loss of the
+// underlying stream. It dials on demand, and whenever the connection drops it
+// dials again, waiting with exponential backoff between failed attempts and
+// after connections that drop right away. Each connection gets a new
+// RpcPeer, on which the services registered with the ClientConn are
+// registered again.
+//
+// Calls fail fast with status.Unavailable while the ClientConn is in
+// TransientFailure, unless made with WaitForReady(true). Calls in progress
+// when a connection drops fail with ErrPeerClosed; they are not retried. When
+// the remote end shuts down gracefully, new calls go to a new connection
+// while the calls in progress finish on the old one.
+type ClientConn struct {
+	dial           DialFunc
+	services       map[string]*service
+	peerOpts       []RpcPeerOption
+	backoff        BackoffConfig
+	connectTimeout time.Duration
+
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the connection loop has stopped
+
+	mu           sync.Mutex
+	state        ConnectivityState
+	stateChanged chan struct{} // closed and replaced on every state change
+	peer         *RpcPeer      // set while Ready
+	lastErr      error         // why the last connection attempt failed
+}
+
+type DialOption func(*ClientConn)
+
+// WithDialPeerOptions sets the options of the RpcPeer created for each
+// connection.
+func WithDialPeerOptions(opts ...RpcPeerOption) DialOption {
+	return func(cc *ClientConn) {
+		cc.peerOpts = append(cc.peerOpts, opts...)
+	}
+}
+
+// WithBackoff sets the backoff between failed connection attempts.
+func WithBackoff(bc BackoffConfig) DialOption {
+	return func(cc *ClientConn) {
+		cc.backoff = bc
+	}
+}
+
+// WithConnectTimeout limits each connection attempt, including the handshake
+// if enabled with WithHandshake, to d.
+func WithConnectTimeout(d time.Duration) DialOption {
+	return func(cc *ClientConn) {
+		cc.connectTimeout = d
+	}
+}
+
+// NewClientConn creates a ClientConn connecting with dial. It starts Idle and
+// connects on the first call or on Connect.
+func NewClientConn(dial DialFunc, opts ...DialOption) *ClientConn {
+	cc := &ClientConn{
+		dial:           dial,
+		services:       make(map[string]*service),
+		backoff:        DefaultBackoffConfig,
+		connectTimeout: DefaultConnectTimeout,
+		stateChanged:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(cc)
+	}
+	cc.ctx, cc.cancel = context.WithCancel(context.Background())
+	return cc
+}
+
+// RegisterService registers svc under name on every connection, like
+// RpcPeer.RegisterService. Services must be registered before the
+// ClientConn connects.
+func (cc *ClientConn) RegisterService(name string, svc interface{}) {
+	cc.services[name] = &service{impl: svc}
+}
+
+// RegisterServiceDesc registers impl on every connection, like
+// RpcPeer.RegisterServiceDesc. Services must be registered before the
+// ClientConn connects.
+func (cc *ClientConn) RegisterServiceDesc(desc *ServiceDesc, impl interface{}) {
+	cc.services[desc.ServiceName] = describedService(desc, impl)
+}
+
+// GetState returns the current state of the ClientConn.
+func (cc *ClientConn) GetState() ConnectivityState {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.state
+}
+
+// WaitForStateChange waits until the state of the ClientConn differs from
+// source or ctx is done. It reports whether the state changed.
+func (cc *ClientConn) WaitForStateChange(ctx context.Context, source ConnectivityState) bool {
+	for {
+		cc.mu.Lock()
+		state, changed := cc.state, cc.stateChanged
+		cc.mu.Unlock()
+
+		if state != source {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Connect makes an Idle ClientConn start connecting without waiting for a
+// call.
+func (cc *ClientConn) Connect() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.connectLocked()
+}
+
+// connectLocked starts the connection loop if the ClientConn is Idle. It must
+// be called with cc.mu held.
+func (cc *ClientConn) connectLocked() {
+	if cc.state != Idle {
+		return
+	}
+	cc.done = make(chan struct{})
+	cc.setStateLocked(Connecting)
+	go cc.run()
+}
+
+// setStateLocked moves the ClientConn to state and wakes up the waiters. It
+// must be called with cc.mu held.
+func (cc *ClientConn) setStateLocked(state ConnectivityState) {
+	if cc.state == state {
+		return
+	}
+	cc.state = state
+	close(cc.stateChanged)
+	cc.stateChanged = make(chan struct{})
+}
+
+// setState moves the ClientConn to state unless it was closed, and reports
+// whether it did.
+func (cc *ClientConn) setState(state ConnectivityState, peer *RpcPeer, err error) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.state == Shutdown {
+		return false
+	}
+	cc.peer = peer
+	cc.lastErr = err
+	cc.setStateLocked(state)
+	return true
+}
+
+// run connects, and reconnects whenever the connection drops or the remote
+// end announces its shutdown with a GOAWAY frame, until the ClientConn is
+// closed. A connection that drops within the base delay of the backoff,
+// without a GOAWAY frame, counts as a failed attempt, so that a remote end
+// closing every connection right away is not redialed in a busy loop.
+func (cc *ClientConn) run() {
+	defer close(cc.done)
+
+	retries := 0
+	for {
+		peer, err := cc.connect()
+		if err == nil {
+			if !cc.setState(Ready, peer, nil) {
+				peer.Close()
+				return
+			}
+			readyAt := time.Now()
+			select {
+			case <-peer.ctx.Done():
+				err = peer.Wait()
+				// Fail the calls still waiting on the lost connection.
+				peer.Close()
+			case <-peer.goAway:
+				// The remote end is shutting down: let the calls in
+				// progress finish while a new connection takes over.
+				go peer.Shutdown(cc.ctx)
+			}
+
+			// A GOAWAY hands the connection over in an orderly way, so a
+			// new one is dialed at once however briefly this one lasted.
+			if peer.goingAway() || time.Since(readyAt) >= cc.backoff.BaseDelay {
+				retries = 0
+				if !cc.setState(Connecting, nil, nil) {
+					return
+				}
+				continue
+			}
+			if err == nil {
+				err = ErrPeerClosed
+			}
+		}
+
+		if !cc.setState(TransientFailure, nil, err) {
+			return
+		}
+		select {
+		case <-time.After(cc.backoff.delay(retries)):
+		case <-cc.ctx.Done():
+			return
+		}
+		retries++
+		if !cc.setState(Connecting, nil, nil) {
+			return
+		}
+	}
+}
+
+// connect dials a new connection and creates its peer.
+func (cc *ClientConn) connect() (*RpcPeer, error) {
+	ctx, cancel := context.WithTimeout(cc.ctx, cc.connectTimeout)
+	defer cancel()
+
+	stream, err := cc.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(cc.peerOpts[:len(cc.peerOpts):len(cc.peerOpts)], withServices(cc.services))
+	peer := NewRpcPeer(stream, opts...)
+	if err := peer.Handshake(ctx); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	return peer, nil
+}
+
+// readyPeer returns the peer of the current connection, connecting first if
+// the ClientConn is Idle. It waits while a connection attempt is in
+// progress or the current peer received a GOAWAY frame, and, if waitForReady
+// is set, also while in TransientFailure.
+func (cc *ClientConn) readyPeer(ctx context.Context, waitForReady bool) (*RpcPeer, error) {
+	for {
+		cc.mu.Lock()
+		cc.connectLocked()
+		state, peer, lastErr, changed := cc.state, cc.peer, cc.lastErr, cc.stateChanged
+		cc.mu.Unlock()
+
+		switch state {
+		case Ready:
+			if !peer.goingAway() {
+				return peer, nil
+			}
+			// The connection loop is about to replace the peer.
+		case Shutdown:
+			return nil, ErrClientConnClosed
+		case TransientFailure:
+			if !waitForReady {
+				return nil, fmt.Errorf("%w: %v", errConnectionFailed, lastErr)
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Call invokes methodName like RpcPeer.Call on the current connection,
+// waiting for a connection attempt in progress.
+func (cc *ClientConn) Call(methodName string, request, response interface{}) error {
+	peer, err := cc.readyPeer(context.Background(), false)
+	if err != nil {
+		return err
+	}
+	return peer.Call(methodName, request, response)
+}
+
+// CallContext invokes methodName like RpcPeer.CallContext on the current
+// connection.
+func (cc *ClientConn) CallContext(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error {
+	peer, err := cc.readyPeer(ctx, newCallOptions(opts).waitForReady)
+	if err != nil {
+		return err
+	}
+	return peer.CallContext(ctx, methodName, request, response, opts...)
+}
+
+// CallStream starts a server-streaming call like RpcPeer.CallStream on the
+// current connection.
+func (cc *ClientConn) CallStream(ctx context.Context, methodName string, request interface{}, opts ...CallOption) (ClientStream, error) {
+	peer, err := cc.readyPeer(ctx, newCallOptions(opts).waitForReady)
+	if err != nil {
+		return nil, err
+	}
+	return peer.CallStream(ctx, methodName, request, opts...)
+}
+
+// OpenStream starts a client- or bidi-streaming call like RpcPeer.OpenStream
+// on the current connection.
+func (cc *ClientConn) OpenStream(ctx context.Context, methodName string, opts ...CallOption) (BidiStream, error) {
+	peer, err := cc.readyPeer(ctx, newCallOptions(opts).waitForReady)
+	if err != nil {
+		return nil, err
+	}
+	return peer.OpenStream(ctx, methodName, opts...)
+}
+
+// Close closes the current connection, failing the calls in progress, and
+// stops reconnecting. Later calls fail with ErrClientConnClosed.
+func (cc *ClientConn) Close() error {
+	cc.mu.Lock()
+	if cc.state == Shutdown {
+		cc.mu.Unlock()
+		return nil
+	}
+	peer, done := cc.peer, cc.done
+	cc.peer = nil
+	cc.setStateLocked(Shutdown)
+	cc.mu.Unlock()
+
+	cc.cancel()
+	var err error
+	if peer != nil {
+		err = peer.Close()
+	}
+	if done != nil {
+		<-done
+	}
+	return err
+}
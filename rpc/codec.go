@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"fmt"
+
+	"github.com/jibuji/go-stream-rpc/rpc/codec"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// WithCodec makes the peer encode the messages of the calls it makes with the
+// codec registered under name in the codec package. The name travels with
+// each request, and the handler replies with the same codec. Calls use the
+// proto codec by default.
+func WithCodec(name string) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.codec = name
+	}
+}
+
+// UseCodec overrides the codec set with WithCodec for a single call.
+func UseCodec(name string) CallOption {
+	return func(o *callOptions) {
+		o.codec = name
+	}
+}
+
+// codecFor returns the codec for the messages of the call made by p.
+func (o *callOptions) codecFor(p *RpcPeer) (codec.Codec, error) {
+	name := o.codec
+	if name == "" {
+		name = p.codec
+	}
+	if name == "" {
+		name = codec.Proto
+	}
+
+	c := codec.Get(name)
+	if c == nil {
+		return nil, status.Errorf(status.Internal, "codec %s not registered", name)
+	}
+	return c, nil
+}
+
+// encodeCodec returns the codec field of a request frame for the codec
+// called name together with the flags describing it. Requests using the
+// proto codec carry no field.
+func (p *RpcPeer) encodeCodec(name string) ([]byte, uint8, error) {
+	if name == "" || name == codec.Proto {
+		return nil, 0, nil
+	}
+	if p.Features()&FeatureCodecs == 0 {
+		return nil, 0, status.Errorf(status.Unimplemented, "remote peer does not support the %s codec", name)
+	}
+
+	field := make([]byte, 0, 1+len(name))
+	field = append(field, uint8(len(name)))
+	return append(field, name...), flagCodec, nil
+}
+
+// decodeCodec reads the codec field of a request frame from the start of
+// body and returns the codec name and the rest of body.
+func decodeCodec(body []byte) (string, []byte, error) {
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return "", nil, fmt.Errorf("request frame too short for codec name")
+	}
+	return string(body[1 : 1+body[0]]), body[1+body[0]:], nil
+}
+
+// requestCodec returns the codec named by a request, or nil if it is not
+// registered.
+func requestCodec(f *frame) codec.Codec {
+	if f.codec == "" {
+		return codec.Get(codec.Proto)
+	}
+	return codec.Get(f.codec)
+}
@@ -0,0 +1,38 @@
+package codec
+
+import "fmt"
+
+// Bytes is the name of the codec passing pre-encoded messages through
+// unchanged. It marshals []byte and *[]byte values and unmarshals into
+// *[]byte.
+const Bytes = "bytes"
+
+func init() {
+	Register(bytesCodec{})
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Name() string {
+	return Bytes
+}
+
+func (bytesCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	}
+	return nil, fmt.Errorf("codec: %T is not []byte or *[]byte", v)
+}
+
+func (bytesCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("codec: %T is not *[]byte", v)
+	}
+	// Copy rather than alias the frame the message arrived in.
+	*b = append((*b)[:0], data...)
+	return nil
+}
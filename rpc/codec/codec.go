@@ -0,0 +1,55 @@
+// Package codec holds the registry of message codecs.
+//
+// A codec turns the messages of a call into the bytes of its frames. The
+// caller picks the codec and names it in the request, and the handler decodes
+// the request and encodes its replies with the same codec. The proto, json
+// and bytes codecs are registered by default; others can be added with
+// Register before peers are created.
+package codec
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MaxNameLen is the longest codec name a request can carry.
+const MaxNameLen = 255
+
+// Codec encodes and decodes messages. Implementations must be safe for
+// concurrent use.
+type Codec interface {
+	// Name identifies the codec in requests. It must not be empty or
+	// longer than MaxNameLen bytes.
+	Name() string
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v, which is a pointer. The decoded
+	// message must not alias data, which is reused for later frames.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+// Register makes c available under c.Name(), replacing any codec registered
+// under the same name. It panics if the name is invalid.
+func Register(c Codec) {
+	name := c.Name()
+	if name == "" || len(name) > MaxNameLen {
+		panic(fmt.Sprintf("codec: invalid codec name %q", name))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	codecs[name] = c
+}
+
+// Get returns the codec registered under name, or nil.
+func Get(name string) Codec {
+	mu.RLock()
+	defer mu.RUnlock()
+	return codecs[name]
+}
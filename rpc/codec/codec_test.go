@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Run("proto", func(t *testing.T) {
+		c := Get(Proto)
+		data, err := c.Marshal(wrapperspb.String("hi"))
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		msg := &wrapperspb.StringValue{}
+		if err := c.Unmarshal(data, msg); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		if msg.Value != "hi" {
+			t.Errorf("Unmarshal got %q, want %q", msg.Value, "hi")
+		}
+		if _, err := c.Marshal("not a message"); err == nil {
+			t.Error("Marshal accepted a non-proto value")
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		c := Get(JSON)
+		data, err := c.Marshal(wrapperspb.Int64(7))
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if string(data) != `"7"` {
+			t.Errorf("Marshal got %s, want the protojson encoding \"7\"", data)
+		}
+		msg := &wrapperspb.Int64Value{}
+		if err := c.Unmarshal(data, msg); err != nil || !proto.Equal(msg, wrapperspb.Int64(7)) {
+			t.Errorf("Unmarshal got %v, %v", msg, err)
+		}
+
+		data, err = c.Marshal(map[string]int{"a": 1})
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var m map[string]int
+		if err := c.Unmarshal(data, &m); err != nil || !reflect.DeepEqual(m, map[string]int{"a": 1}) {
+			t.Errorf("Unmarshal got %v, %v", m, err)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		c := Get(Bytes)
+		data, err := c.Marshal([]byte("raw"))
+		if err != nil || string(data) != "raw" {
+			t.Fatalf("Marshal got %q, %v", data, err)
+		}
+		var b []byte
+		if err := c.Unmarshal(data, &b); err != nil || string(b) != "raw" {
+			t.Errorf("Unmarshal got %q, %v", b, err)
+		}
+		data[0] = 'R'
+		if string(b) != "raw" {
+			t.Error("Unmarshal aliased its input")
+		}
+		if _, err := c.Marshal("raw"); err == nil {
+			t.Error("Marshal accepted a string")
+		}
+	})
+}
+
+func TestRegister(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Register accepted an empty name")
+		}
+	}()
+	Register(namedCodec(""))
+}
+
+type namedCodec string
+
+func (c namedCodec) Name() string                               { return string(c) }
+func (c namedCodec) Marshal(v interface{}) ([]byte, error)      { return nil, nil }
+func (c namedCodec) Unmarshal(data []byte, v interface{}) error { return nil }
@@ -0,0 +1,38 @@
+package codec
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto is the name of the protobuf codec, which calls use unless they select
+// another one.
+const Proto = "proto"
+
+func init() {
+	Register(protoCodec{})
+}
+
+// protoCodec encodes protobuf messages in the binary wire format.
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return Proto
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("codec: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("codec: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
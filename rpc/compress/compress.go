@@ -0,0 +1,84 @@
+// Package compress holds the registry of message compressors.
+//
+// Peers that complete the handshake announce the compressors they have
+// registered, and each end only compresses messages with a compressor the
+// other end announced. The gzip, zstd and snappy compressors are registered
+// by default; others can be added with Register before peers are created.
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Compressor compresses and decompresses messages. Implementations must be
+// safe for concurrent use.
+type Compressor interface {
+	// Name identifies the compressor in the handshake. It must not be
+	// empty or contain commas.
+	Name() string
+	// Compress returns the compressed form of data.
+	Compress(data []byte) ([]byte, error)
+	// Decompress reverses Compress. It fails with an error wrapping
+	// ErrTooLarge if the decompressed data would be larger than maxSize
+	// bytes.
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+// ErrTooLarge is returned, wrapped, by Decompress when the decompressed
+// message exceeds the size limit.
+var ErrTooLarge = errors.New("compress: decompressed message too large")
+
+var (
+	mu          sync.RWMutex
+	compressors = make(map[string]Compressor)
+	names       []string // registration order
+)
+
+// Register makes c available under c.Name(), replacing any compressor
+// registered under the same name. It panics if the name is invalid.
+func Register(c Compressor) {
+	name := c.Name()
+	if name == "" || strings.Contains(name, ",") {
+		panic(fmt.Sprintf("compress: invalid compressor name %q", name))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := compressors[name]; !ok {
+		names = append(names, name)
+	}
+	compressors[name] = c
+}
+
+// Get returns the compressor registered under name, or nil.
+func Get(name string) Compressor {
+	mu.RLock()
+	defer mu.RUnlock()
+	return compressors[name]
+}
+
+// Names returns the names of the registered compressors in the order they
+// were first registered.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), names...)
+}
+
+// readLimited reads r to the end, failing once more than maxSize bytes have
+// been read.
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, maxSize)
+	}
+	return data, nil
+}
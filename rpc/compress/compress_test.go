@@ -0,0 +1,68 @@
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte("stream-rpc "), 1000)
+
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			c := Get(name)
+			if c == nil {
+				t.Fatalf("Compressor %s not registered", name)
+			}
+
+			compressed, err := c.Compress(data)
+			if err != nil {
+				t.Fatalf("Compress failed: %v", err)
+			}
+			if len(compressed) >= len(data) {
+				t.Errorf("Compressed %d bytes to %d", len(data), len(compressed))
+			}
+
+			for i := 0; i < 2; i++ { // again with pooled state
+				decompressed, err := c.Decompress(compressed, len(data))
+				if err != nil {
+					t.Fatalf("Decompress failed: %v", err)
+				}
+				if !bytes.Equal(decompressed, data) {
+					t.Fatal("Decompress did not restore the data")
+				}
+			}
+
+			if _, err := c.Decompress(compressed, len(data)-1); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Decompress beyond the size limit returned %v, want ErrTooLarge", err)
+			}
+			if _, err := c.Decompress([]byte("garbage"), len(data)); err == nil {
+				t.Error("Decompress accepted garbage")
+			}
+		})
+	}
+}
+
+type testCompressor struct{ name string }
+
+func (c testCompressor) Name() string                                  { return c.name }
+func (c testCompressor) Compress(data []byte) ([]byte, error)          { return data, nil }
+func (c testCompressor) Decompress(data []byte, _ int) ([]byte, error) { return data, nil }
+
+func TestRegister(t *testing.T) {
+	Register(testCompressor{"test"})
+	if Get("test") == nil {
+		t.Error("Registered compressor not found")
+	}
+	if names := Names(); names[len(names)-1] != "test" {
+		t.Errorf("Names() = %v, want test last", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register accepted a name with a comma")
+		}
+	}()
+	Register(testCompressor{"a,b"})
+}
@@ -0,0 +1,32 @@
+package compress
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func init() {
+	Register(snappyCompressor{})
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrTooLarge, n, maxSize)
+	}
+	return snappy.Decode(nil, data)
+}
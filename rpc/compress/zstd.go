@@ -0,0 +1,52 @@
+package compress
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	Register(&zstdCompressor{})
+}
+
+type zstdCompressor struct {
+	encoderOnce sync.Once
+	encoder     *zstd.Encoder
+	encoderErr  error
+	decoders    sync.Pool
+}
+
+func (c *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	// EncodeAll is safe for concurrent use, so one encoder serves all
+	// peers.
+	c.encoderOnce.Do(func() {
+		c.encoder, c.encoderErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	if c.encoderErr != nil {
+		return nil, c.encoderErr
+	}
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte, maxSize int) ([]byte, error) {
+	d, ok := c.decoders.Get().(*zstd.Decoder)
+	if ok {
+		if err := d.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if d, err = zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	}
+	defer c.decoders.Put(d)
+
+	return readLimited(d, maxSize)
+}
@@ -0,0 +1,153 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jibuji/go-stream-rpc/rpc/compress"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+const (
+	// DefaultCompressionThreshold is the size in bytes below which messages
+	// are sent uncompressed when no WithCompressionThreshold option is
+	// given.
+	DefaultCompressionThreshold = 1024
+
+	// settingCompressors is the preface setting listing the compressors a
+	// peer can decode, as comma-separated names. A compressed frame refers
+	// to a compressor by its index in the receiver's list.
+	settingCompressors = 1
+
+	// maxCompressors is the number of compressors a one-byte index can
+	// refer to.
+	maxCompressors = 256
+)
+
+// WithCompressor makes the peer compress the messages it sends with the
+// compressor registered under name in the compress package: the requests of
+// its calls, and the responses to requests that arrived uncompressed.
+// Responses to compressed requests use the compressor of the request.
+//
+// Compression needs the handshake; messages are sent uncompressed if it is
+// disabled, if the remote end did not announce the compressor or if the
+// message is smaller than the compression threshold.
+func WithCompressor(name string) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.compressor = name
+	}
+}
+
+// WithCompressionThreshold sets the size in bytes below which messages are
+// sent uncompressed, since compressing small messages costs more than it
+// saves.
+func WithCompressionThreshold(n int) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.compressionThreshold = n
+	}
+}
+
+// UseCompressor overrides the compressor set with WithCompressor for the
+// messages of a single call. An empty name sends them uncompressed.
+func UseCompressor(name string) CallOption {
+	return func(o *callOptions) {
+		o.compressor, o.compressorSet = name, true
+	}
+}
+
+// compressorFor returns the name of the compressor for the messages of the
+// call made by p.
+func (o *callOptions) compressorFor(p *RpcPeer) string {
+	if o.compressorSet {
+		return o.compressor
+	}
+	return p.compressor
+}
+
+// compressorSetting returns the value of the compressors setting announcing
+// the compressors this peer decodes, and remembers them by index.
+func (p *RpcPeer) compressorSetting() []byte {
+	names := compress.Names()
+	if len(names) > maxCompressors {
+		names = names[:maxCompressors]
+	}
+	for _, name := range names {
+		p.decompressors = append(p.decompressors, compress.Get(name))
+	}
+	return []byte(strings.Join(names, ","))
+}
+
+// setRemoteCompressors records the compressors announced by the remote end.
+func (p *RpcPeer) setRemoteCompressors(setting []byte) {
+	if len(setting) == 0 {
+		return
+	}
+	p.remoteCompressors = make(map[string]uint8)
+	for i, name := range strings.Split(string(setting), ",") {
+		if i >= maxCompressors {
+			break
+		}
+		if _, ok := p.remoteCompressors[name]; !ok {
+			p.remoteCompressors[name] = uint8(i)
+		}
+	}
+}
+
+// compress compresses payload with the compressor called name if the remote
+// end can decode it and the payload is large enough to be worth it. It
+// returns the flags to add to the frame and the payload to send, prefixed
+// with the compressor's index if compressed.
+func (p *RpcPeer) compress(name string, payload []byte) (uint8, []byte) {
+	if name == "" || len(payload) == 0 || len(payload) < p.compressionThreshold || p.Features()&FeatureCompression == 0 {
+		return 0, payload
+	}
+
+	index, ok := p.remoteCompressors[name]
+	c := compress.Get(name)
+	if !ok || c == nil {
+		return 0, payload
+	}
+
+	compressed, err := c.Compress(payload)
+	if err != nil || len(compressed)+1 >= len(payload) {
+		// Send what is smaller; a failing compressor costs only the
+		// savings.
+		return 0, payload
+	}
+
+	body := make([]byte, 0, 1+len(compressed))
+	body = append(body, index)
+	return flagCompressed, append(body, compressed...)
+}
+
+// decompress replaces the payload of a compressed frame with its
+// decompressed form and records the compressor in the frame. A payload that
+// fails to decompress, or exceeds the receive limit once decompressed, only
+// fails its call: it sets recvErr in the frame rather than returning an
+// error.
+func (p *RpcPeer) decompress(f *frame) error {
+	if len(f.payload) < 1 {
+		return fmt.Errorf("compressed frame too short")
+	}
+
+	index := int(f.payload[0])
+	if index >= len(p.decompressors) {
+		return fmt.Errorf("unknown compressor index %d", index)
+	}
+
+	c := p.decompressors[index]
+	payload, err := c.Decompress(f.payload[1:], p.maxRecvMsgSize)
+	f.release()
+	if err != nil {
+		code := status.Internal
+		if errors.Is(err, compress.ErrTooLarge) {
+			code = status.ResourceExhausted
+		}
+		f.recvErr = status.Errorf(code, "failed to decompress %s message: %v", c.Name(), err)
+		return nil
+	}
+	f.payload = payload
+	f.compressor = c.Name()
+	return nil
+}
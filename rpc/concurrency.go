@@ -0,0 +1,166 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+type overloadAction int
+
+const (
+	rejectRequests overloadAction = iota
+	queueRequests
+	blockReading
+)
+
+// OverloadPolicy decides what happens to requests that arrive while the peer
+// is handling as many requests as WithMaxConcurrentRequests allows.
+type OverloadPolicy struct {
+	action   overloadAction
+	maxQueue int
+}
+
+// RejectRequests answers excess requests with a status.ResourceExhausted
+// error. It is the default policy.
+func RejectRequests() OverloadPolicy {
+	return OverloadPolicy{action: rejectRequests}
+}
+
+// QueueRequests holds up to n excess requests until a handler finishes and
+// rejects the rest like RejectRequests. Queued requests whose caller gives up
+// are dropped from the queue.
+func QueueRequests(n int) OverloadPolicy {
+	return OverloadPolicy{action: queueRequests, maxQueue: n}
+}
+
+// BlockReading stops reading from the connection until a handler finishes,
+// pushing back on the remote end. Everything else arriving on the
+// connection waits as well, including the responses to calls this peer
+// makes, so handlers must not wait for calls to the same remote end.
+func BlockReading() OverloadPolicy {
+	return OverloadPolicy{action: blockReading}
+}
+
+// WithMaxConcurrentRequests limits the number of requests, unary and
+// streaming, the peer handles at once. Requests beyond the limit are treated
+// according to the overload policy set with WithOverloadPolicy. A
+// non-positive n removes the limit, which is the default.
+func WithMaxConcurrentRequests(n int) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.maxConcurrentRequests = n
+	}
+}
+
+// WithOverloadPolicy sets what happens to requests beyond the limit set with
+// WithMaxConcurrentRequests.
+func WithOverloadPolicy(policy OverloadPolicy) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.overloadPolicy = policy
+	}
+}
+
+// RequestStats reports the load of the requests a peer handles.
+type RequestStats struct {
+	// InFlight is the number of requests being handled.
+	InFlight int
+	// Queued is the number of requests waiting for a handler to finish.
+	Queued int
+	// Rejected is the number of requests rejected because of the
+	// concurrency limit since the peer was created.
+	Rejected uint64
+}
+
+// requestCounters are the counters behind RequestStats.
+type requestCounters struct {
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Uint64
+}
+
+// RequestStats returns the current load of the requests the peer handles.
+func (p *RpcPeer) RequestStats() RequestStats {
+	return RequestStats{
+		InFlight: int(p.requestCounters.inFlight.Load()),
+		Queued:   int(p.requestCounters.queued.Load()),
+		Rejected: p.requestCounters.rejected.Load(),
+	}
+}
+
+// dispatchRequest starts the handler of a request registered with
+// startRequest, applying the concurrency limit. It is called by the read
+// loop.
+func (p *RpcPeer) dispatchRequest(ctx context.Context, f *frame, stream *rpcStream) {
+	if p.handlerSlots == nil {
+		go p.runHandler(ctx, f, stream)
+		return
+	}
+
+	select {
+	case p.handlerSlots <- struct{}{}:
+		go p.runHandler(ctx, f, stream)
+		return
+	default:
+	}
+
+	counters := &p.requestCounters
+	switch p.overloadPolicy.action {
+	case blockReading:
+		counters.queued.Add(1)
+		defer counters.queued.Add(-1)
+
+		select {
+		case p.handlerSlots <- struct{}{}:
+			go p.runHandler(ctx, f, stream)
+		case <-p.ctx.Done():
+			p.dropRequest(f)
+		}
+	case queueRequests:
+		if counters.queued.Add(1) > int64(p.overloadPolicy.maxQueue) {
+			counters.queued.Add(-1)
+			p.rejectRequest(f)
+			return
+		}
+
+		go func() {
+			select {
+			case p.handlerSlots <- struct{}{}:
+				counters.queued.Add(-1)
+				p.runHandler(ctx, f, stream)
+			case <-ctx.Done():
+				counters.queued.Add(-1)
+				p.dropRequest(f)
+			}
+		}()
+	default:
+		p.rejectRequest(f)
+	}
+}
+
+// runHandler handles a request that holds a handler slot, if there is a
+// limit, and releases the slot when done.
+func (p *RpcPeer) runHandler(ctx context.Context, f *frame, stream *rpcStream) {
+	p.requestCounters.inFlight.Add(1)
+	defer func() {
+		p.requestCounters.inFlight.Add(-1)
+		if p.handlerSlots != nil {
+			<-p.handlerSlots
+		}
+	}()
+
+	p.handleRequest(ctx, f, stream)
+}
+
+// rejectRequest answers a request beyond the concurrency limit.
+func (p *RpcPeer) rejectRequest(f *frame) {
+	p.requestCounters.rejected.Add(1)
+	p.dropRequest(f)
+	go p.writeErrorResponse(p.ctx, f.id, status.ResourceExhausted, "too many concurrent requests")
+}
+
+// dropRequest forgets a request whose handler never runs.
+func (p *RpcPeer) dropRequest(f *frame) {
+	p.finishRequest(f.id)
+	f.release()
+}
@@ -0,0 +1,228 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// ProtocolVersion is the highest protocol version this package speaks.
+	ProtocolVersion = 1
+
+	// minProtocolVersion is the lowest protocol version this package speaks.
+	minProtocolVersion = 1
+
+	// DefaultHandshakeTimeout is how long a peer waits for the remote
+	// preface when no WithHandshakeTimeout option is given.
+	DefaultHandshakeTimeout = 10 * time.Second
+
+	// prefaceMagic opens every preface.
+	prefaceMagic = "SRPC"
+
+	// prefaceSize is the size of the fixed part of a preface: magic,
+	// version, features, max frame size and settings length.
+	prefaceSize = 4 + 1 + 4 + 4 + 2
+)
+
+// Feature is a set of optional protocol features.
+type Feature uint32
+
+const (
+	FeatureStreaming   Feature = 1 << iota // Streaming calls
+	FeatureMetadata                        // Request and response metadata
+	FeatureCompression                     // Compressed payloads
+	FeatureMethodIDs                       // Numeric method IDs in requests
+	FeatureCodecs                          // Requests naming a codec other than proto
+	FeatureDeadlines                       // Requests carrying the caller's remaining timeout
+)
+
+const (
+	// supportedFeatures are the features this package implements.
+	supportedFeatures = FeatureStreaming | FeatureMetadata | FeatureCompression | FeatureMethodIDs | FeatureCodecs | FeatureDeadlines
+
+	// defaultFeatures are the features used without a handshake. Method
+	// IDs are left out: peers predating them would misread the requests.
+	// Codecs are only used when a call selects one.
+	defaultFeatures = FeatureStreaming | FeatureMetadata | FeatureCodecs | FeatureDeadlines
+)
+
+// ErrIncompatiblePeer is returned, wrapped, when the handshake finds that the
+// remote end cannot talk to this peer.
+var ErrIncompatiblePeer = errors.New("rpc: incompatible peer")
+
+// preface is the first thing each end writes when the handshake is enabled.
+//
+//	[magic "SRPC"][version (1)][features (4)][max frame size (4)][settings length (2)][settings]
+//
+// Settings are a sequence of [id (1)][length (2)][value] entries. Entries
+// with unknown IDs are ignored, so new settings can be added without a
+// version bump.
+type preface struct {
+	version      uint8
+	features     Feature
+	maxFrameSize uint32
+	settings     map[uint8][]byte
+}
+
+// WithHandshake makes the peer exchange a preface with the remote end before
+// any call is made. Both ends announce their protocol version, the features
+// they support and the largest frame they accept; the peers then use the
+// lower version, the common features and never send frames larger than the
+// remote limit. Both ends must enable the handshake.
+//
+// Calls wait until the handshake has finished. If it fails, the peer is
+// closed, ErrorChannel reports the error and calls return it.
+func WithHandshake() RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.handshake = true
+	}
+}
+
+// WithHandshakeTimeout sets how long the handshake may take before the peer
+// gives up. It implies WithHandshake.
+func WithHandshakeTimeout(d time.Duration) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.handshake = true
+		p.handshakeTimeout = d
+	}
+}
+
+// Handshake waits until the handshake with the remote end has finished and
+// returns its error. It returns nil at once if the handshake is disabled.
+func (p *RpcPeer) Handshake(ctx context.Context) error {
+	select {
+	case <-p.handshakeDone:
+		return p.handshakeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Features returns the features both ends support. Without a handshake,
+// streaming, metadata and codecs are assumed to be available.
+func (p *RpcPeer) Features() Feature {
+	<-p.handshakeDone
+	return p.features
+}
+
+// runHandshake writes the local preface and reads the remote one, both at
+// once so that neither end blocks on a synchronous stream.
+func (p *RpcPeer) runHandshake() error {
+	local := &preface{
+		version:      ProtocolVersion,
+		features:     supportedFeatures,
+		maxFrameSize: p.maxRecvFrameSize(),
+		settings: map[uint8][]byte{
+			settingCompressors: p.compressorSetting(),
+		},
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := p.Stream.Write(local.marshal())
+		writeErr <- err
+	}()
+
+	type result struct {
+		remote *preface
+		err    error
+	}
+	readResult := make(chan result, 1)
+	go func() {
+		remote, err := readPreface(p.reader)
+		readResult <- result{remote, err}
+	}()
+
+	timer := time.NewTimer(p.handshakeTimeout)
+	defer timer.Stop()
+
+	var remote *preface
+	for remote == nil || writeErr != nil {
+		select {
+		case err := <-writeErr:
+			if err != nil {
+				return fmt.Errorf("rpc: handshake failed: %w", err)
+			}
+			writeErr = nil
+		case r := <-readResult:
+			if r.err != nil {
+				return r.err
+			}
+			remote = r.remote
+		case <-timer.C:
+			return fmt.Errorf("rpc: handshake timed out after %v", p.handshakeTimeout)
+		case <-p.ctx.Done():
+			return fmt.Errorf("rpc: handshake aborted: %w", p.ctx.Err())
+		}
+	}
+
+	if remote.version < minProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d not supported", ErrIncompatiblePeer, remote.version)
+	}
+
+	p.features = local.features & remote.features
+	p.maxSendFrameSize = remote.maxFrameSize
+	p.setRemoteCompressors(remote.settings[settingCompressors])
+	return nil
+}
+
+func (f *preface) marshal() []byte {
+	var settings []byte
+	for id, value := range f.settings {
+		settings = append(settings, id)
+		settings = binary.BigEndian.AppendUint16(settings, uint16(len(value)))
+		settings = append(settings, value...)
+	}
+
+	b := make([]byte, 0, prefaceSize+len(settings))
+	b = append(b, prefaceMagic...)
+	b = append(b, f.version)
+	b = binary.BigEndian.AppendUint32(b, uint32(f.features))
+	b = binary.BigEndian.AppendUint32(b, f.maxFrameSize)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(settings)))
+	return append(b, settings...)
+}
+
+func readPreface(r io.Reader) (*preface, error) {
+	var fixed [prefaceSize]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("rpc: handshake failed: %w", err)
+	}
+	if !bytes.Equal(fixed[:4], []byte(prefaceMagic)) {
+		return nil, fmt.Errorf("%w: no protocol preface received; the remote end must enable the handshake", ErrIncompatiblePeer)
+	}
+
+	f := &preface{
+		version:      fixed[4],
+		features:     Feature(binary.BigEndian.Uint32(fixed[5:9])),
+		maxFrameSize: binary.BigEndian.Uint32(fixed[9:13]),
+		settings:     make(map[uint8][]byte),
+	}
+	if f.maxFrameSize < frameHeaderSize {
+		return nil, fmt.Errorf("%w: max frame size %d too small", ErrIncompatiblePeer, f.maxFrameSize)
+	}
+
+	settings := make([]byte, binary.BigEndian.Uint16(fixed[13:15]))
+	if _, err := io.ReadFull(r, settings); err != nil {
+		return nil, fmt.Errorf("rpc: handshake failed: %w", err)
+	}
+	for len(settings) > 0 {
+		if len(settings) < 3 {
+			return nil, fmt.Errorf("%w: malformed preface settings", ErrIncompatiblePeer)
+		}
+		id, length := settings[0], int(binary.BigEndian.Uint16(settings[1:3]))
+		settings = settings[3:]
+		if len(settings) < length {
+			return nil, fmt.Errorf("%w: malformed preface settings", ErrIncompatiblePeer)
+		}
+		f.settings[id] = settings[:length]
+		settings = settings[length:]
+	}
+
+	return f, nil
+}
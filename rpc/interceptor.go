@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+)
+
+// UnaryServerInfo describes a unary call to an interceptor.
+type UnaryServerInfo struct {
+	// Server is the service the call is dispatched to.
+	Server interface{}
+	// FullMethod is the method name as sent by the caller, "Service.Method".
+	FullMethod string
+}
+
+// UnaryHandler runs the rest of the chain of a unary call: the remaining
+// interceptors and finally the service method.
+type UnaryHandler func(ctx context.Context, req interface{}) (interface{}, error)
+
+// UnaryServerInterceptor intercepts unary calls handled by a peer. It may
+// inspect or replace the request, the context, the response and the error; it
+// calls handler to continue the call, or returns without calling it to fail
+// the call early.
+type UnaryServerInterceptor func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error)
+
+// StreamServerInfo describes a streaming call to an interceptor.
+type StreamServerInfo struct {
+	// FullMethod is the method name as sent by the caller, "Service.Method".
+	FullMethod string
+	// IsClientStream is set if the caller sends a stream of messages.
+	IsClientStream bool
+	// IsServerStream is set if the handler sends a stream of messages.
+	IsServerStream bool
+}
+
+// StreamHandler runs the rest of the chain of a streaming call: the remaining
+// interceptors and finally the service method. For server-streaming calls the
+// request is the single message Recv returns before io.EOF.
+type StreamHandler func(srv interface{}, stream BidiStream) error
+
+// StreamServerInterceptor intercepts streaming calls handled by a peer. It
+// may wrap stream to observe or alter the messages, or its Context method to
+// pass values on to the handler.
+type StreamServerInterceptor func(srv interface{}, stream BidiStream, info *StreamServerInfo, handler StreamHandler) error
+
+// UnaryInvoker sends a unary call and waits for its response: the remaining
+// interceptors and finally the call on the connection.
+type UnaryInvoker func(ctx context.Context, method string, req, resp interface{}, opts ...CallOption) error
+
+// UnaryClientInterceptor intercepts unary calls made by a peer. It may add
+// call options or outgoing metadata and inspect the response and the error;
+// it calls invoker to make the call.
+type UnaryClientInterceptor func(ctx context.Context, method string, req, resp interface{}, invoker UnaryInvoker, opts ...CallOption) error
+
+// StreamDesc describes a streaming call to an interceptor.
+type StreamDesc struct {
+	// ClientStreams is set if the caller sends a stream of messages.
+	ClientStreams bool
+	// ServerStreams is set if the handler sends a stream of messages.
+	ServerStreams bool
+}
+
+// Streamer starts a streaming call: the remaining interceptors and finally
+// the call on the connection. For server-streaming calls the request is sent
+// by the first Send on the returned stream.
+type Streamer func(ctx context.Context, desc *StreamDesc, method string, opts ...CallOption) (BidiStream, error)
+
+// StreamClientInterceptor intercepts streaming calls made by a peer. It calls
+// streamer to start the call and may wrap the returned stream.
+type StreamClientInterceptor func(ctx context.Context, desc *StreamDesc, method string, streamer Streamer, opts ...CallOption) (BidiStream, error)
+
+// WithUnaryServerInterceptor adds interceptors to the unary calls this peer
+// handles. Interceptors run in the order they are added, the first one
+// outermost.
+func WithUnaryServerInterceptor(interceptors ...UnaryServerInterceptor) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.unaryServerInterceptors = append(p.unaryServerInterceptors, interceptors...)
+	}
+}
+
+// WithStreamServerInterceptor adds interceptors to the streaming calls this
+// peer handles. Interceptors run in the order they are added, the first one
+// outermost.
+func WithStreamServerInterceptor(interceptors ...StreamServerInterceptor) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.streamServerInterceptors = append(p.streamServerInterceptors, interceptors...)
+	}
+}
+
+// WithUnaryClientInterceptor adds interceptors to the unary calls this peer
+// makes with Call and CallContext. Interceptors run in the order they are
+// added, the first one outermost.
+func WithUnaryClientInterceptor(interceptors ...UnaryClientInterceptor) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.unaryClientInterceptors = append(p.unaryClientInterceptors, interceptors...)
+	}
+}
+
+// WithStreamClientInterceptor adds interceptors to the streaming calls this
+// peer makes with CallStream and OpenStream. Interceptors run in the order
+// they are added, the first one outermost.
+func WithStreamClientInterceptor(interceptors ...StreamClientInterceptor) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.streamClientInterceptors = append(p.streamClientInterceptors, interceptors...)
+	}
+}
+
+// chainUnaryInterceptors combines interceptors into one that runs them in
+// order, or returns nil if there are none.
+func chainUnaryInterceptors(interceptors []UnaryServerInterceptor) UnaryServerInterceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		return chainUnaryHandler(interceptors, info, handler)(ctx, req)
+	}
+}
+
+// chainUnaryHandler returns a handler running interceptors in order before
+// final.
+func chainUnaryHandler(interceptors []UnaryServerInterceptor, info *UnaryServerInfo, final UnaryHandler) UnaryHandler {
+	if len(interceptors) == 0 {
+		return final
+	}
+	next := chainUnaryHandler(interceptors[1:], info, final)
+	return func(ctx context.Context, req interface{}) (interface{}, error) {
+		return interceptors[0](ctx, req, info, next)
+	}
+}
+
+// chainStreamHandler returns a handler running interceptors in order before
+// final.
+func chainStreamHandler(interceptors []StreamServerInterceptor, info *StreamServerInfo, final StreamHandler) StreamHandler {
+	if len(interceptors) == 0 {
+		return final
+	}
+	next := chainStreamHandler(interceptors[1:], info, final)
+	return func(srv interface{}, stream BidiStream) error {
+		return interceptors[0](srv, stream, info, next)
+	}
+}
+
+// chainUnaryInvoker returns an invoker running interceptors in order before
+// final.
+func chainUnaryInvoker(interceptors []UnaryClientInterceptor, final UnaryInvoker) UnaryInvoker {
+	if len(interceptors) == 0 {
+		return final
+	}
+	next := chainUnaryInvoker(interceptors[1:], final)
+	return func(ctx context.Context, method string, req, resp interface{}, opts ...CallOption) error {
+		return interceptors[0](ctx, method, req, resp, next, opts...)
+	}
+}
+
+// chainStreamer returns a streamer running interceptors in order before
+// final.
+func chainStreamer(interceptors []StreamClientInterceptor, final Streamer) Streamer {
+	if len(interceptors) == 0 {
+		return final
+	}
+	next := chainStreamer(interceptors[1:], final)
+	return func(ctx context.Context, desc *StreamDesc, method string, opts ...CallOption) (BidiStream, error) {
+		return interceptors[0](ctx, desc, method, next, opts...)
+	}
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// WithMaxRecvMsgSize sets the size in bytes of the largest message the peer
+// accepts, counting the metadata and method name sent along with it. The
+// limit is announced in the handshake, so that a remote end using it fails
+// oversized calls before sending them. A message that arrives anyway is
+// skipped and fails its call with status.ResourceExhausted, leaving the
+// connection and other calls unaffected, unless it is more than four times
+// the limit, which closes the connection. The default is MaxMessageSize.
+func WithMaxRecvMsgSize(n int) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.maxRecvMsgSize = n
+	}
+}
+
+// WithMaxSendMsgSize sets the size in bytes of the largest message the peer
+// sends. Sending a larger message fails with status.ResourceExhausted without
+// writing anything. The default is MaxMessageSize.
+func WithMaxSendMsgSize(n int) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.maxSendMsgSize = n
+	}
+}
+
+// checkSendSize returns an error if an encoded message of n bytes exceeds
+// the send limit.
+func (p *RpcPeer) checkSendSize(n int) error {
+	if n > p.maxSendMsgSize {
+		return status.Errorf(status.ResourceExhausted, "message of %d bytes exceeds the send limit of %d bytes", n, p.maxSendMsgSize)
+	}
+	return nil
+}
+
+// maxRecvFrameSize returns the largest frame the peer accepts, as announced
+// in the handshake.
+func (p *RpcPeer) maxRecvFrameSize() uint32 {
+	if p.maxRecvMsgSize > math.MaxUint32-frameHeaderSize {
+		return math.MaxUint32
+	}
+	return uint32(p.maxRecvMsgSize + frameHeaderSize)
+}
+
+// maxSkipFactor bounds the oversized frames a peer reads past: a frame more
+// than this many times the receive limit is not a message that happens to be
+// too large but a broken or hostile peer, and closes the connection rather
+// than keeping the read loop busy discarding it.
+const maxSkipFactor = 4
+
+// skipOversized discards the body of a frame exceeding the receive limit and
+// returns the frame with recvErr set in place of its contents.
+func (p *RpcPeer) skipOversized(f *frame, bodyLen int) (*frame, error) {
+	if int64(bodyLen) > maxSkipFactor*int64(p.maxRecvMsgSize) {
+		return nil, fmt.Errorf("frame of %d bytes is far beyond the receive limit of %d bytes", bodyLen, p.maxRecvMsgSize)
+	}
+	if f.flags&flagMethodDef != 0 {
+		// Dropping the definition would garble every later call of the
+		// method. Peers defining method IDs have done the handshake and
+		// know the limit, so only a broken peer gets here.
+		return nil, fmt.Errorf("oversized request frame defines a method ID")
+	}
+	if _, err := io.CopyN(io.Discard, p.reader, int64(bodyLen)); err != nil {
+		return nil, err
+	}
+	f.recvErr = status.Errorf(status.ResourceExhausted, "received message of %d bytes exceeds the limit of %d bytes", bodyLen, p.maxRecvMsgSize)
+	return f, nil
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jibuji/go-stream-rpc/rpc/codec"
+	"github.com/jibuji/go-stream-rpc/rpc/metadata"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+var (
+	errNoCall     = errors.New("rpc: context does not belong to a call being handled")
+	errHeaderSent = errors.New("rpc: header already sent")
+)
+
+// handlerCall holds the state of a call being handled: the response
+// metadata the handler sets and the codec and compressor for its messages.
+type handlerCall struct {
+	codec      codec.Codec // nil if the request named an unknown codec
+	compressor string
+
+	mu         sync.Mutex
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+}
+
+type handlerCallKey struct{}
+
+func handlerCallFrom(ctx context.Context) *handlerCall {
+	call, _ := ctx.Value(handlerCallKey{}).(*handlerCall)
+	return call
+}
+
+// SetHeader adds md to the header sent to the caller of the call ctx belongs
+// to. The header goes out with the first frame the handler sends: the
+// response of a unary call, or the first message or end of a stream. It
+// fails once the header has been sent, and with status.InvalidArgument for
+// keys that cannot be sent.
+func SetHeader(ctx context.Context, md metadata.MD) error {
+	call := handlerCallFrom(ctx)
+	if call == nil {
+		return errNoCall
+	}
+	if err := checkMetadata(md); err != nil {
+		return err
+	}
+
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	if call.headerSent {
+		return errHeaderSent
+	}
+	call.header = metadata.Join(call.header, md)
+	return nil
+}
+
+// SetTrailer adds md to the trailer sent to the caller of the call ctx
+// belongs to when the call ends. It fails with status.InvalidArgument for
+// keys that cannot be sent.
+func SetTrailer(ctx context.Context, md metadata.MD) error {
+	call := handlerCallFrom(ctx)
+	if call == nil {
+		return errNoCall
+	}
+	if err := checkMetadata(md); err != nil {
+		return err
+	}
+
+	call.mu.Lock()
+	defer call.mu.Unlock()
+
+	call.trailer = metadata.Join(call.trailer, md)
+	return nil
+}
+
+// take returns the header if it has not been sent yet and, for the frame
+// ending the call, the trailer.
+func (c *handlerCall) take(last bool) (header, trailer metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.headerSent {
+		header, c.headerSent = c.header, true
+	}
+	if last {
+		trailer, c.trailer = c.trailer, nil
+	}
+	return header, trailer
+}
+
+// writeReply sends a frame of the handler of the call ctx belongs to,
+// carrying the header and, if last is set, the trailer the handler has set.
+// The payload of responses and stream messages is compressed with the call's
+// compressor.
+func (p *RpcPeer) writeReply(ctx context.Context, id uint32, typ frameType, payload []byte, last bool) error {
+	call := handlerCallFrom(ctx)
+	if call == nil {
+		return p.writeFrame(id, typ, 0, payload)
+	}
+
+	var flags uint8
+	if typ == frameResponse || typ == frameStreamMessage {
+		flags, payload = p.compress(call.compressor, payload)
+	}
+
+	header, trailer := call.take(last)
+	if p.Features()&FeatureMetadata == 0 || (len(header) == 0 && len(trailer) == 0) {
+		return p.writeFrame(id, typ, flags, payload)
+	}
+
+	var blocks []byte
+	if len(header) > 0 {
+		flags |= flagHeader
+		blocks = appendMetadata(blocks, header)
+	}
+	if len(trailer) > 0 {
+		flags |= flagTrailer
+		blocks = appendMetadata(blocks, trailer)
+	}
+	return p.writeFrame(id, typ, flags, blocks, payload)
+}
+
+// maxMetadataKeyLen is the length of the longest metadata key the encoding
+// can carry.
+const maxMetadataKeyLen = 255
+
+// checkMetadata returns a status.InvalidArgument error if md has a key too
+// long to be sent.
+func checkMetadata(md metadata.MD) error {
+	for key := range md {
+		if len(key) > maxMetadataKeyLen {
+			return status.Errorf(status.InvalidArgument, "metadata key %q is longer than %d bytes", key, maxMetadataKeyLen)
+		}
+	}
+	return nil
+}
+
+// appendMetadata appends the encoding of md to b:
+// [block length (4)] followed by [key length (1)][key][value length (4)][value]
+// for each value. The keys must have passed checkMetadata.
+func appendMetadata(b []byte, md metadata.MD) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	for key, values := range md {
+		for _, value := range values {
+			b = append(b, uint8(len(key)))
+			b = append(b, key...)
+			b = binary.BigEndian.AppendUint32(b, uint32(len(value)))
+			b = append(b, value...)
+		}
+	}
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+// readMetadata decodes a metadata block from the start of b and returns it
+// together with the rest of b.
+func readMetadata(b []byte) (metadata.MD, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("frame too short for metadata")
+	}
+	blockLen := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < blockLen {
+		return nil, nil, fmt.Errorf("metadata block truncated")
+	}
+	block, rest := b[:blockLen], b[blockLen:]
+
+	md := metadata.MD{}
+	for len(block) > 0 {
+		keyLen := int(block[0])
+		if len(block) < 1+keyLen+4 {
+			return nil, nil, fmt.Errorf("metadata entry truncated")
+		}
+		key := string(block[1 : 1+keyLen])
+		block = block[1+keyLen:]
+
+		valueLen := binary.BigEndian.Uint32(block)
+		block = block[4:]
+		if uint32(len(block)) < valueLen {
+			return nil, nil, fmt.Errorf("metadata entry truncated")
+		}
+		md.Append(key, string(block[:valueLen]))
+		block = block[valueLen:]
+	}
+	return md, rest, nil
+}
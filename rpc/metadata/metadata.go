@@ -0,0 +1,129 @@
+// Package metadata carries key-value pairs alongside calls, such as auth
+// tokens, trace IDs or client versions.
+//
+// Callers attach metadata to the context passed to a call with
+// NewOutgoingContext or AppendToOutgoingContext. Handlers read it from their
+// context with FromIncomingContext. Keys are case insensitive and stored in
+// lower case; a key may have several values.
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MD maps lower-case keys to their values.
+type MD map[string][]string
+
+// New creates an MD from a map of single values.
+func New(m map[string]string) MD {
+	md := make(MD, len(m))
+	for k, v := range m {
+		md.Append(k, v)
+	}
+	return md
+}
+
+// Pairs creates an MD from alternating keys and values. It panics if kv has
+// an odd number of elements.
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic(fmt.Sprintf("metadata: Pairs got an odd number of arguments: %d", len(kv)))
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md.Append(kv[i], kv[i+1])
+	}
+	return md
+}
+
+// Len returns the number of keys in md.
+func (md MD) Len() int {
+	return len(md)
+}
+
+// Copy returns a deep copy of md.
+func (md MD) Copy() MD {
+	c := make(MD, len(md))
+	for k, v := range md {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// Get returns the values for key.
+func (md MD) Get(key string) []string {
+	return md[strings.ToLower(key)]
+}
+
+// Set replaces the values for key.
+func (md MD) Set(key string, vals ...string) {
+	if len(vals) == 0 {
+		return
+	}
+	md[strings.ToLower(key)] = vals
+}
+
+// Append adds values to key.
+func (md MD) Append(key string, vals ...string) {
+	if len(vals) == 0 {
+		return
+	}
+	key = strings.ToLower(key)
+	md[key] = append(md[key], vals...)
+}
+
+// Delete removes key.
+func (md MD) Delete(key string) {
+	delete(md, strings.ToLower(key))
+}
+
+// Join merges mds into a new MD, appending the values of keys present in
+// several of them.
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = append(out[k], v...)
+		}
+	}
+	return out
+}
+
+type (
+	outgoingKey struct{}
+	incomingKey struct{}
+)
+
+// NewOutgoingContext returns a context carrying md to be sent with calls made
+// with it. It replaces any outgoing metadata already in ctx.
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext returns a context whose outgoing metadata is that of
+// ctx with the given key-value pairs added.
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext returns the outgoing metadata in ctx.
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext returns a context carrying md as received with a call.
+// It is used by the framework and by tests of handlers.
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext returns the metadata the caller sent with the call
+// the handler's ctx belongs to.
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
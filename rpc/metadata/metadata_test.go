@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPairs(t *testing.T) {
+	md := Pairs("Key", "a", "key", "b", "other", "c")
+	want := MD{"key": {"a", "b"}, "other": {"c"}}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("Pairs() = %v, want %v", md, want)
+	}
+	if got := md.Get("KEY"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Get() = %v", got)
+	}
+}
+
+func TestMD_Copy(t *testing.T) {
+	md := New(map[string]string{"k": "v"})
+	c := md.Copy()
+	c.Append("k", "w")
+	if len(md.Get("k")) != 1 {
+		t.Error("Copy shares values with the original")
+	}
+}
+
+func TestOutgoingContext(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("a", "1"))
+	ctx = AppendToOutgoingContext(ctx, "a", "2", "b", "3")
+
+	md, ok := FromOutgoingContext(ctx)
+	if !ok {
+		t.Fatal("FromOutgoingContext found no metadata")
+	}
+	want := MD{"a": {"1", "2"}, "b": {"3"}}
+	if !reflect.DeepEqual(md, want) {
+		t.Errorf("FromOutgoingContext() = %v, want %v", md, want)
+	}
+
+	if _, ok := FromIncomingContext(ctx); ok {
+		t.Error("Outgoing metadata visible as incoming")
+	}
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+const (
+	// maxMethodNameLen is the longest method name the legacy encoding, with
+	// its one-byte length, can carry.
+	maxMethodNameLen = 255
+
+	// maxMethodIDs bounds the number of method IDs either end of a
+	// connection defines. Calls of further methods carry the name instead.
+	maxMethodIDs = 4096
+)
+
+// encodeMethod returns the method field of a request frame for name together
+// with the flags describing it. When the method IDs feature was negotiated,
+// the first call of a method defines the next free ID for it and later calls
+// send the ID alone; define reports that the field defines a new ID, which
+// the caller records with defineMethod once the frame is on its way. It must
+// be called with writeMu held, so that definitions reach the remote end in
+// the order the IDs are assigned.
+func (p *RpcPeer) encodeMethod(name string) (field []byte, flags uint8, define bool, err error) {
+	if p.Features()&FeatureMethodIDs != 0 {
+		if id, ok := p.methodIDs[name]; ok {
+			return binary.AppendUvarint(nil, id), flagMethodID, false, nil
+		}
+		if len(p.methodIDs) < maxMethodIDs {
+			field = binary.AppendUvarint(nil, uint64(len(p.methodIDs)))
+			field = binary.AppendUvarint(field, uint64(len(name)))
+			return append(field, name...), flagMethodID | flagMethodDef, true, nil
+		}
+	}
+
+	if len(name) > maxMethodNameLen {
+		return nil, 0, false, status.Errorf(status.InvalidArgument, "method name of %d bytes exceeds the limit of %d bytes", len(name), maxMethodNameLen)
+	}
+	field = make([]byte, 0, 1+len(name))
+	field = append(field, uint8(len(name)))
+	return append(field, name...), 0, false, nil
+}
+
+// defineMethod records the ID assigned to name by encodeMethod. It must be
+// called with writeMu held.
+func (p *RpcPeer) defineMethod(name string) {
+	p.methodIDs[name] = uint64(len(p.methodIDs))
+}
+
+// decodeMethod reads the method field of a request frame from the start of
+// body and returns the method name and the rest of body. Definitions of
+// method IDs are recorded for later frames. It is only called by the read
+// loop.
+func (p *RpcPeer) decodeMethod(flags uint8, body []byte) (string, []byte, error) {
+	if flags&flagMethodID == 0 {
+		if len(body) < 1 || len(body) < 1+int(body[0]) {
+			return "", nil, fmt.Errorf("request frame too short for method name")
+		}
+		return string(body[1 : 1+body[0]]), body[1+body[0]:], nil
+	}
+
+	id, n := binary.Uvarint(body)
+	if n <= 0 {
+		return "", nil, fmt.Errorf("malformed method ID")
+	}
+	body = body[n:]
+
+	if flags&flagMethodDef == 0 {
+		if id >= uint64(len(p.remoteMethods)) {
+			return "", nil, fmt.Errorf("unknown method ID %d", id)
+		}
+		return p.remoteMethods[id], body, nil
+	}
+
+	nameLen, n := binary.Uvarint(body)
+	if n <= 0 || nameLen > uint64(len(body)-n) {
+		return "", nil, fmt.Errorf("request frame too short for method name")
+	}
+	if id != uint64(len(p.remoteMethods)) || id >= maxMethodIDs {
+		return "", nil, fmt.Errorf("unexpected definition of method ID %d", id)
+	}
+	name := string(body[n : n+int(nameLen)])
+	p.remoteMethods = append(p.remoteMethods, name)
+	return name, body[n+int(nameLen):], nil
+}
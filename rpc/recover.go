@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"runtime/debug"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// Panic describes a panic recovered while handling a call.
+type Panic struct {
+	// Method is the method name as sent by the caller, "Service.Method".
+	Method string
+	// Value is the value the handler panicked with.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+	// StackHash identifies the stack trace. It is included in the error sent
+	// to the caller, so reports from callers can be matched with the panic
+	// without exposing the trace itself.
+	StackHash string
+}
+
+// PanicHandler is called with every panic recovered while handling a call.
+type PanicHandler func(p *Panic)
+
+// WithPanicHandler sets the function called when a service method or server
+// interceptor panics. The caller receives an Internal error and the peer
+// keeps serving other calls. By default the panic and its stack trace are
+// written to the standard logger; a nil handler disables the report.
+func WithPanicHandler(h PanicHandler) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.panicHandler = h
+	}
+}
+
+// defaultPanicHandler logs the panic with the standard logger.
+func defaultPanicHandler(p *Panic) {
+	log.Printf("rpc: panic handling %s: %v (stack %s)\n%s", p.Method, p.Value, p.StackHash, p.Stack)
+}
+
+// recovered reports the panic value v raised while handling method and
+// returns the error to send to the caller in its place.
+func (p *RpcPeer) recovered(method string, v interface{}) error {
+	stack := debug.Stack()
+	h := fnv.New32a()
+	h.Write(stack)
+
+	pv := &Panic{
+		Method:    method,
+		Value:     v,
+		Stack:     stack,
+		StackHash: fmt.Sprintf("%08x", h.Sum32()),
+	}
+	if p.panicHandler != nil {
+		p.panicHandler(pv)
+	}
+
+	return status.Errorf(status.Internal, "panic handling %s (stack %s)", method, pv.StackHash)
+}
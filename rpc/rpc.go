@@ -1,27 +1,97 @@
 package rpc
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/jibuji/go-stream-rpc/rpc/compress"
+	"github.com/jibuji/go-stream-rpc/rpc/metadata"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
 	"github.com/jibuji/go-stream-rpc/session"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 const (
 	RequestIDMSB   = uint32(0x80000000) // Most significant bit mask
 	RequestIDMask  = uint32(0x7fffffff) // Mask for actual request ID value
-	MaxMessageSize = 10 * 1024 * 1024   // 10MB
+	MaxMessageSize = 10 * 1024 * 1024   // Default limit on the size of messages sent and received, 10MB
+
+	// DefaultCallTimeout is the deadline Call applies when no WithCallTimeout
+	// option is given.
+	DefaultCallTimeout = 30 * time.Second
+
+	// DefaultInitialWindowSize is the number of message bytes either end of a
+	// stream may send before it has to wait for the receiver to grant more.
+	DefaultInitialWindowSize = 64 * 1024
+
+	// frameHeaderSize is the number of bytes following the length prefix that
+	// every frame carries: the ID, the frame type and the flags.
+	frameHeaderSize = 6
+)
+
+// frameType identifies the kind of a frame on the wire.
+type frameType uint8
+
+const (
+	frameRequest       frameType = iota // Call request carrying a method name and payload
+	frameResponse                       // Successful response to a request
+	frameError                          // Error response to a request
+	frameCancel                         // Caller abandoned the request with the same ID
+	frameStreamMessage                  // One message of a streaming call, in either direction
+	frameStreamClose                    // Handler finished a streaming call successfully
+	frameStreamOpen                     // Call request opening a client- or bidi-streaming call
+	frameHalfClose                      // Caller will send no more messages on the stream
+	frameWindowUpdate                   // Receiver grants more send window on a stream
+	frameGoAway                         // Sender handles no requests after the one with the same ID
+)
+
+// Frame flags
+const (
+	flagTimeout    uint8 = 1 << iota // Request carries the caller's remaining timeout
+	flagStream                       // Request starts a server-streaming call
+	flagHeader                       // Frame carries request metadata or the response header
+	flagTrailer                      // Frame carries the response trailer
+	flagMethodID                     // Request names its method by ID
+	flagMethodDef                    // Request defines the method ID it uses
+	flagCompressed                   // Payload is compressed
+	flagCodec                        // Request names the codec of its messages
 )
 
+// frame is a single decoded message read from the stream.
+type frame struct {
+	id         uint32
+	typ        frameType
+	flags      uint8
+	method     string
+	deadline   time.Time
+	header     metadata.MD // request metadata, or response header
+	trailer    metadata.MD
+	compressor string // compressor the payload arrived compressed with
+	codec      string // codec named by a request, empty for proto
+	payload    []byte
+	buf        *buffer // pooled buffer backing payload, nil once released
+	recvErr    error   // set instead of the payload when the message was rejected
+}
+
+// release returns the buffer backing the payload to the pool once the
+// payload has been decoded. Decoded messages never alias the payload, since
+// codecs copy what they keep.
+func (f *frame) release() {
+	if f.buf != nil {
+		f.buf.free()
+		f.buf, f.payload = nil, nil
+	}
+}
+
 type Stream interface {
 	io.Reader
 	io.Writer
@@ -29,37 +99,123 @@ type Stream interface {
 }
 
 type RpcPeer struct {
-	Stream        Stream
-	services      map[string]interface{}
-	nextRequestID uint32
-	mu            sync.Mutex
-	writeMu       sync.Mutex
-	readMu        sync.Mutex
-	pendingCalls  map[uint32]chan []byte
-	ctx           context.Context
-	cancel        context.CancelFunc
-	errChan       chan error
+	Stream         Stream
+	reader         *bufio.Reader // reads Stream; only used by the read loop
+	services       map[string]*service
+	nextRequestID  uint32
+	mu             sync.Mutex
+	writeMu        sync.Mutex
+	readMu         sync.Mutex
+	pendingCalls   map[uint32]chan *frame
+	inflight       map[uint32]context.CancelFunc
+	streams        map[uint32]*rpcStream // Streaming calls made by this peer
+	remoteStreams  map[uint32]*rpcStream // Streaming calls handled by this peer
+	closed         bool                  // Close was called
+	draining       bool                  // Shutdown was called; requests are refused
+	lastRemoteID   uint32                // highest request ID accepted from the remote end
+	goAwayReceived bool                  // the remote end is shutting down
+	goAway         chan struct{}         // closed when goAwayReceived is set
+	drained        chan struct{}         // set by Shutdown, closed once no calls remain
+	session        session.Session
+	ctx            context.Context
+	cancel         context.CancelFunc
+	errChan        chan error
+	callTimeout    time.Duration
+	initialWindow  uint32
+
+	writeQueue   chan *buffer  // frames for the write loop, nil without write batching
+	writeDone    chan struct{} // closed when the write loop has stopped
+	writeErr     error         // why the write loop stopped, set before writeDone is closed
+	maxBatchSize int
+	flushDelay   time.Duration
+
+	handshake        bool
+	handshakeTimeout time.Duration
+	handshakeDone    chan struct{} // closed once the handshake has finished or when there is none
+	handshakeErr     error
+	features         Feature // features both ends support
+	maxSendFrameSize uint32  // largest frame the remote end accepts, 0 until announced in the handshake
+	maxSendMsgSize   int
+	maxRecvMsgSize   int
+	methodIDs        map[string]uint64 // IDs of the methods this peer calls, guarded by writeMu
+	remoteMethods    []string          // methods the remote end calls, by ID; only used by the read loop
+
+	panicHandler PanicHandler
+
+	maxConcurrentRequests int
+	overloadPolicy        OverloadPolicy
+	handlerSlots          chan struct{} // one token per running handler, nil without a limit
+	requestCounters       requestCounters
+
+	compressor           string                // compressor for the messages this peer sends
+	compressionThreshold int                   // smallest message worth compressing
+	decompressors        []compress.Compressor // compressors announced to the remote end, by index
+	remoteCompressors    map[string]uint8      // compressors announced by the remote end
+
+	codec string // codec for the messages of the calls this peer makes
+
+	unaryServerInterceptors  []UnaryServerInterceptor
+	streamServerInterceptors []StreamServerInterceptor
+	unaryClientInterceptors  []UnaryClientInterceptor
+	streamClientInterceptors []StreamClientInterceptor
+	unaryInterceptor         UnaryServerInterceptor // the server interceptors chained, nil if there are none
+	invoker                  UnaryInvoker           // unary calls through the client interceptors
+	streamer                 Streamer               // streaming calls through the client interceptors
 }
 
 type RpcPeerOption func(*RpcPeer)
 
 func WithSession(s session.Session) RpcPeerOption {
 	return func(p *RpcPeer) {
-		p.ctx = context.WithValue(context.Background(), session.SessionContextKey, s)
+		p.session = s
 	}
 }
 
-func NewRpcPeer(stream Stream, opts ...RpcPeerOption) *RpcPeer {
-	ctx, cancel := context.WithCancel(session.CreateDefaultSessionContext())
+// WithCallTimeout sets the timeout Call applies to every request. A
+// non-positive duration disables the timeout, leaving Call to wait until the
+// response arrives or the peer is closed. It has no effect on CallContext,
+// whose deadline is controlled by the caller's context.
+func WithCallTimeout(d time.Duration) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.callTimeout = d
+	}
+}
+
+// WithInitialWindowSize sets the receive window this peer grants to the
+// remote end of every stream: the number of message bytes the remote end may
+// send before the application has consumed them. A slow consumer thereby
+// pushes back on its own stream only, leaving other calls on the connection
+// unaffected. Sizes below DefaultInitialWindowSize are raised to it.
+func WithInitialWindowSize(n uint32) RpcPeerOption {
+	return func(p *RpcPeer) {
+		p.initialWindow = n
+	}
+}
 
+func NewRpcPeer(stream Stream, opts ...RpcPeerOption) *RpcPeer {
 	peer := &RpcPeer{
 		Stream:        stream,
-		services:      make(map[string]interface{}),
+		reader:        bufio.NewReaderSize(stream, readBufferSize),
+		services:      make(map[string]*service),
 		nextRequestID: 1,
-		pendingCalls:  make(map[uint32]chan []byte),
-		ctx:           ctx,
-		cancel:        cancel,
+		pendingCalls:  make(map[uint32]chan *frame),
+		inflight:      make(map[uint32]context.CancelFunc),
+		streams:       make(map[uint32]*rpcStream),
+		remoteStreams: make(map[uint32]*rpcStream),
 		errChan:       make(chan error, 1),
+		goAway:        make(chan struct{}),
+		callTimeout:   DefaultCallTimeout,
+		initialWindow: DefaultInitialWindowSize,
+
+		handshakeTimeout: DefaultHandshakeTimeout,
+		handshakeDone:    make(chan struct{}),
+		features:         defaultFeatures,
+		maxSendMsgSize:   MaxMessageSize,
+		maxRecvMsgSize:   MaxMessageSize,
+		methodIDs:        make(map[string]uint64),
+		panicHandler:     defaultPanicHandler,
+
+		compressionThreshold: DefaultCompressionThreshold,
 	}
 
 	// Apply options
@@ -67,14 +223,38 @@ func NewRpcPeer(stream Stream, opts ...RpcPeerOption) *RpcPeer {
 		opt(peer)
 	}
 
+	// Every request context is derived from the peer context, so closing the
+	// peer cancels all in-flight handlers.
+	baseCtx := session.CreateDefaultSessionContext()
+	if peer.initialWindow < DefaultInitialWindowSize {
+		peer.initialWindow = DefaultInitialWindowSize
+	}
+
+	if peer.session != nil {
+		baseCtx = context.WithValue(context.Background(), session.SessionContextKey, peer.session)
+	}
+	peer.ctx, peer.cancel = context.WithCancel(baseCtx)
+
+	if !peer.handshake {
+		close(peer.handshakeDone)
+	}
+
+	peer.unaryInterceptor = chainUnaryInterceptors(peer.unaryServerInterceptors)
+	peer.invoker = chainUnaryInvoker(peer.unaryClientInterceptors, peer.invoke)
+	peer.streamer = chainStreamer(peer.streamClientInterceptors, peer.newStream)
+
+	if peer.maxConcurrentRequests > 0 {
+		peer.handlerSlots = make(chan struct{}, peer.maxConcurrentRequests)
+	}
+
+	if peer.writeQueue != nil {
+		peer.writeDone = make(chan struct{})
+		go peer.writeLoop()
+	}
 	go peer.handleMessages()
 	return peer
 }
 
-func (p *RpcPeer) RegisterService(name string, service interface{}) {
-	p.services[name] = service
-}
-
 func (p *RpcPeer) getNextRequestID() uint32 {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -103,55 +283,142 @@ func (p *RpcPeer) getNextRequestID() uint32 {
 	return id
 }
 
-func (p *RpcPeer) Call(methodName string, request proto.Message, response proto.Message) error {
-	requestBytes, err := proto.Marshal(request)
+// Call invokes methodName on the remote peer, waiting at most the peer's call
+// timeout (see WithCallTimeout) for the response.
+func (p *RpcPeer) Call(methodName string, request, response interface{}) error {
+	ctx := context.Background()
+	if p.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.callTimeout)
+		defer cancel()
+	}
+	return p.CallContext(ctx, methodName, request, response)
+}
+
+// CallContext invokes methodName on the remote peer and waits for the response
+// until it arrives or ctx is done. The deadline of ctx, if any, is sent along
+// with the request so the remote handler's context expires with it. If ctx
+// expires or is cancelled first, the pending call is discarded, the remote
+// handler is told to stop and ctx.Err() is returned, i.e.
+// context.DeadlineExceeded or context.Canceled.
+func (p *RpcPeer) CallContext(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return p.invoker(ctx, methodName, request, response, opts...)
+}
+
+// invoke makes a unary call on the connection. It is the end of the client
+// interceptor chain.
+func (p *RpcPeer) invoke(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error {
+	o := newCallOptions(opts)
+	ctx, cancel := o.context(ctx)
+	defer cancel()
+
+	if err := p.Handshake(ctx); err != nil {
+		return err
+	}
+
+	cdc, err := o.codecFor(p)
+	if err != nil {
+		return err
+	}
+	requestBytes, err := cdc.Marshal(request)
 	if err != nil {
 		return err
 	}
+	if err := p.checkSendSize(len(requestBytes)); err != nil {
+		return err
+	}
 
 	requestID := p.getNextRequestID()
-	responseChan := make(chan []byte, 1)
+	responseChan := make(chan *frame, 1)
 
 	p.mu.Lock()
+	if err := p.callsRefused(); err != nil {
+		p.mu.Unlock()
+		return err
+	}
 	p.pendingCalls[requestID] = responseChan
 	p.mu.Unlock()
 
 	defer func() {
 		p.mu.Lock()
 		delete(p.pendingCalls, requestID)
+		p.checkDrained()
 		p.mu.Unlock()
 	}()
 
-	if err := p.writeRequest(requestID, methodName, requestBytes); err != nil {
+	deadline, _ := ctx.Deadline()
+	md, _ := metadata.FromOutgoingContext(ctx)
+	flags, requestBytes := p.compress(o.compressorFor(p), requestBytes)
+	if err := p.writeRequest(frameRequest, requestID, methodName, cdc.Name(), flags, deadline, md, requestBytes); err != nil {
 		return err
 	}
 
 	select {
-	case responseBytes := <-responseChan:
-		// Check if it's an error response by looking at the second MSB
-		if (requestID & uint32(0x40000000)) != 0 {
-			rpcErr, err := p.readErrorResponse(responseBytes)
-			if err != nil {
-				return fmt.Errorf("failed to read error response: %v", err)
+	case f := <-responseChan:
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			// Arrived as the deadline passed, possibly before the context
+			// noticed; the caller has given up on it either way.
+			f.release()
+			return context.DeadlineExceeded
+		}
+		o.received(f)
+
+		// The frame type alone tells success from failure; anything that
+		// goes wrong past this point is reported as a status error too.
+		defer f.release()
+		if f.recvErr != nil {
+			return f.recvErr
+		}
+		switch f.typ {
+		case frameResponse:
+			if err := cdc.Unmarshal(f.payload, response); err != nil {
+				return status.Errorf(status.Internal, "failed to unmarshal response: %v", err)
 			}
-			return rpcErr
+			return nil
+		case frameError:
+			return p.callError(f)
+		default:
+			return status.Errorf(status.Internal, "unexpected frame type %d in response to unary call", f.typ)
 		}
-		return proto.Unmarshal(responseBytes, response)
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("RPC call timeout")
+	case <-ctx.Done():
+		// Don't block the caller on a congested stream just to notify the
+		// remote; the cancellation is best effort.
+		go p.writeCancel(requestID)
+		return ctx.Err()
 	}
 }
 
 func (p *RpcPeer) handleMessages() {
 	defer close(p.errChan)
 
+	if p.handshake {
+		p.handshakeErr = p.runHandshake()
+		close(p.handshakeDone)
+		if p.handshakeErr != nil {
+			p.errChan <- p.handshakeErr
+			p.cancel()
+			p.Stream.Close()
+			return
+		}
+	}
+
 	for {
 		select {
 		case <-p.ctx.Done():
 			return
 		default:
-			_, requestID, methodName, payload, err := p.readMessage()
+			f, err := p.readMessage()
 			if err != nil {
+				if p.ctx.Err() != nil {
+					// Closed by this peer; there is nothing to report.
+					p.failStreams(io.ErrUnexpectedEOF)
+					p.failCalls(ErrPeerClosed, allCalls)
+					return
+				}
 				if websocket.IsCloseError(err,
 					websocket.CloseNormalClosure,
 					websocket.CloseGoingAway,
@@ -162,207 +429,427 @@ func (p *RpcPeer) handleMessages() {
 					p.errChan <- fmt.Errorf("stream error: %w", err)
 				}
 				p.cancel() // Cancel context to signal shutdown
+				// Nothing more can be read, so let the remote end, which may be
+				// in the middle of writing, see the connection end.
+				p.Stream.Close()
+				p.failStreams(io.ErrUnexpectedEOF)
+				p.failCalls(ErrPeerClosed, allCalls)
 				return
 			}
 
-			isResponse := (requestID & RequestIDMSB) != 0
-			if isResponse {
-				originalRequestID := requestID & RequestIDMask
+			switch f.typ {
+			case frameResponse, frameError, frameStreamMessage, frameStreamClose, frameHalfClose, frameWindowUpdate:
+				if f.id&RequestIDMSB == 0 {
+					// Sent by the caller of a stream this peer is handling
+					p.dispatchRemoteStreamFrame(f)
+					break
+				}
+
+				originalRequestID := f.id & RequestIDMask
 				p.mu.Lock()
 				responseChan, ok := p.pendingCalls[originalRequestID]
+				delete(p.pendingCalls, originalRequestID)
+				stream, isStream := p.streams[originalRequestID]
+				if isStream && f.typ != frameStreamMessage && f.typ != frameWindowUpdate {
+					delete(p.streams, originalRequestID)
+				}
+				p.checkDrained()
 				p.mu.Unlock()
 
 				if ok {
-					responseChan <- payload
+					responseChan <- f
+				} else if isStream {
+					p.dispatchStreamFrame(stream, f)
 				}
-			} else {
-				go p.handleRequest(requestID, methodName, payload)
+			case frameRequest, frameStreamOpen:
+				if f.recvErr != nil {
+					go p.writeHandlerError(p.ctx, f.id, f.recvErr)
+					break
+				}
+				// Register the request context, and the stream for streaming
+				// calls, before the next frame is read so that a cancel frame
+				// or stream message following right behind finds them.
+				ctx, ok := p.startRequest(f)
+				if !ok {
+					f.release()
+					go p.writeHandlerError(p.ctx, f.id, ErrPeerClosed)
+					break
+				}
+				var stream *rpcStream
+				if f.typ == frameStreamOpen || f.flags&flagStream != 0 {
+					stream = p.acceptStream(ctx, f.id)
+				}
+				p.dispatchRequest(ctx, f, stream)
+			case frameCancel:
+				p.cancelRequest(f.id)
+			case frameGoAway:
+				p.handleGoAway(f.id)
 			}
 		}
 	}
 }
 
-func (p *RpcPeer) readMessage() (uint32, uint32, string, []byte, error) {
+func (p *RpcPeer) readMessage() (*frame, error) {
 	p.readMu.Lock()
 	defer p.readMu.Unlock()
 
-	var length uint32
-	s := p.Stream
-
-	if err := binary.Read(s, binary.BigEndian, &length); err != nil {
-		return 0, 0, "", nil, err
+	var header [4 + frameHeaderSize]byte
+	if _, err := io.ReadFull(p.reader, header[:]); err != nil {
+		return nil, err
 	}
 
-	if length < 4 || length > MaxMessageSize {
-		return 0, 0, "", nil, fmt.Errorf("invalid message length: %d bytes", length)
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < frameHeaderSize {
+		return nil, fmt.Errorf("invalid message length: %d bytes", length)
 	}
 
-	var requestID uint32
-	if err := binary.Read(s, binary.BigEndian, &requestID); err != nil {
-		return 0, 0, "", nil, err
+	f := &frame{
+		id:    binary.BigEndian.Uint32(header[4:8]),
+		typ:   frameType(header[8]),
+		flags: header[9],
+	}
+	bodyLen := int(length - frameHeaderSize)
+	if bodyLen > p.maxRecvMsgSize {
+		return p.skipOversized(f, bodyLen)
 	}
 
-	var methodName string
-	var payload []byte
+	f.buf = getBuffer(bodyLen)
+	body := f.buf.b
+	if _, err := io.ReadFull(p.reader, body); err != nil {
+		return nil, err
+	}
 
-	if (requestID & RequestIDMSB) == 0 {
-		// Request message
-		var methodNameLen uint8
-		if err := binary.Read(s, binary.BigEndian, &methodNameLen); err != nil {
-			return 0, 0, "", nil, err
+	isRequest := f.typ == frameRequest || f.typ == frameStreamOpen
+	if isRequest && f.flags&flagTimeout != 0 {
+		if len(body) < 8 {
+			return nil, fmt.Errorf("request frame too short for timeout")
 		}
+		timeout := int64(binary.BigEndian.Uint64(body))
+		f.deadline = time.Now().Add(time.Duration(timeout))
+		body = body[8:]
+	}
 
-		methodNameBytes := make([]byte, methodNameLen)
-		if _, err := io.ReadFull(s, methodNameBytes); err != nil {
-			return 0, 0, "", nil, err
+	var err error
+	if f.flags&flagHeader != 0 {
+		if f.header, body, err = readMetadata(body); err != nil {
+			return nil, err
+		}
+	}
+	if f.flags&flagTrailer != 0 {
+		if f.trailer, body, err = readMetadata(body); err != nil {
+			return nil, err
 		}
-		methodName = string(methodNameBytes)
+	}
 
-		payloadLen := length - uint32(methodNameLen) - 5
-		payload = make([]byte, payloadLen)
-		if _, err := io.ReadFull(s, payload); err != nil {
-			return 0, 0, "", nil, err
+	if isRequest {
+		if f.method, body, err = p.decodeMethod(f.flags, body); err != nil {
+			return nil, err
 		}
-	} else {
-		// Response message
-		payloadLen := length - 4
-		payload = make([]byte, payloadLen)
-		if _, err := io.ReadFull(s, payload); err != nil {
-			return 0, 0, "", nil, err
+		if f.flags&flagCodec != 0 {
+			if f.codec, body, err = decodeCodec(body); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return length, requestID, methodName, payload, nil
+	f.payload = body
+	if f.flags&flagCompressed != 0 {
+		if err := p.decompress(f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
-func (p *RpcPeer) writeRequest(requestID uint32, methodName string, payload []byte) error {
+// appendFrameHeader appends the length prefix and the common frame header
+// for a frame with bodyLen bytes of body to b.
+func (p *RpcPeer) appendFrameHeader(b []byte, bodyLen int, id uint32, typ frameType, flags uint8) ([]byte, error) {
+	// Without a handshake the remote limit is unknown and only the send
+	// limit, checked by the callers, applies.
+	if size := bodyLen + frameHeaderSize; p.maxSendFrameSize != 0 && size > int(p.maxSendFrameSize) {
+		return nil, status.Errorf(status.ResourceExhausted, "frame of %d bytes exceeds the remote limit of %d bytes", size, p.maxSendFrameSize)
+	}
+
+	b = binary.BigEndian.AppendUint32(b, uint32(bodyLen+frameHeaderSize))
+	b = binary.BigEndian.AppendUint32(b, id)
+	return append(b, byte(typ), flags), nil
+}
+
+// writeFrame sends a frame whose body is the concatenation of parts. The
+// frame is assembled in a pooled buffer and written with a single call, so
+// that it costs one system call, or one message on message-based streams.
+func (p *RpcPeer) writeFrame(id uint32, typ frameType, flags uint8, parts ...[]byte) error {
+	bodyLen := 0
+	for _, part := range parts {
+		bodyLen += len(part)
+	}
+
+	buf := getBuffer(0)
+	b, err := p.appendFrameHeader(buf.b, bodyLen, id, typ, flags)
+	if err != nil {
+		buf.free()
+		return err
+	}
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	buf.b = b
+
 	p.writeMu.Lock()
 	defer p.writeMu.Unlock()
 
-	methodNameBytes := []byte(methodName)
-	totalLength := uint32(len(payload) + len(methodNameBytes) + 5)
-	s := p.Stream
-	if err := binary.Write(s, binary.BigEndian, totalLength); err != nil {
+	return p.sendFrame(buf)
+}
+
+// writeRequest sends a request or stream open frame whose messages are
+// encoded with the codec called codecName. A non-zero deadline is transmitted
+// as the remaining timeout, if the remote end supports FeatureDeadlines, so
+// that the remote handler's context expires at the same moment regardless of
+// clock skew between the peers.
+func (p *RpcPeer) writeRequest(typ frameType, requestID uint32, methodName, codecName string, flags uint8, deadline time.Time, md metadata.MD, payload []byte) error {
+	codecField, codecFlags, err := p.encodeCodec(codecName)
+	if err != nil {
 		return err
 	}
+	flags |= codecFlags
 
-	if err := binary.Write(s, binary.BigEndian, requestID); err != nil {
-		return err
+	var mdBlock []byte
+	if len(md) > 0 && p.Features()&FeatureMetadata != 0 {
+		if err := checkMetadata(md); err != nil {
+			return err
+		}
+		flags |= flagHeader
+		mdBlock = appendMetadata(nil, md)
 	}
 
-	if err := binary.Write(s, binary.BigEndian, uint8(len(methodNameBytes))); err != nil {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	method, methodFlags, define, err := p.encodeMethod(methodName)
+	if err != nil {
 		return err
 	}
+	flags |= methodFlags
+
+	bodyLen := len(payload) + len(mdBlock) + len(method) + len(codecField)
+	if !deadline.IsZero() && p.Features()&FeatureDeadlines != 0 {
+		flags |= flagTimeout
+		bodyLen += 8
+	}
 
-	if _, err := s.Write(methodNameBytes); err != nil {
+	buf := getBuffer(0)
+	b, err := p.appendFrameHeader(buf.b, bodyLen, requestID, typ, flags)
+	if err != nil {
+		buf.free()
 		return err
 	}
+	if flags&flagTimeout != 0 {
+		timeout := time.Until(deadline)
+		if timeout < 0 {
+			timeout = 0
+		}
+		b = binary.BigEndian.AppendUint64(b, uint64(timeout))
+	}
+	b = append(b, mdBlock...)
+	b = append(b, method...)
+	b = append(b, codecField...)
+	b = append(b, payload...)
+	buf.b = b
 
-	_, err := s.Write(payload)
-	return err
+	if err := p.sendFrame(buf); err != nil {
+		return err
+	}
+	if define {
+		p.defineMethod(methodName)
+	}
+	return nil
 }
 
-func (p *RpcPeer) writeResponse(requestID uint32, payload []byte) error {
-	// Ensure the incoming requestID doesn't have MSB set
-	requestID &= RequestIDMask
+// writeResponse sends the response of the handler of the call ctx belongs
+// to, along with the header and trailer the handler has set.
+func (p *RpcPeer) writeResponse(ctx context.Context, requestID uint32, payload []byte) error {
+	responseID := (requestID & RequestIDMask) | RequestIDMSB
+	return p.writeReply(ctx, responseID, frameResponse, payload, true)
+}
 
-	// Set MSB for response
-	p.writeMu.Lock()
-	defer p.writeMu.Unlock()
+// writeCancel tells the remote peer that the caller is no longer interested
+// in the response to requestID.
+func (p *RpcPeer) writeCancel(requestID uint32) error {
+	return p.writeFrame(requestID&RequestIDMask, frameCancel, 0, nil)
+}
 
-	responseID := requestID | RequestIDMSB
+// startRequest registers the context for an incoming request, or reports
+// false if the peer no longer accepts requests. The context is derived from
+// the peer context and is cancelled when the request's deadline passes, when
+// the caller sends a cancel frame or when the handler finishes.
+func (p *RpcPeer) startRequest(f *frame) (context.Context, bool) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if !f.deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(p.ctx, f.deadline)
+	} else {
+		ctx, cancel = context.WithCancel(p.ctx)
+	}
 
-	// Validate the resulting ID
-	if (responseID & RequestIDMask) != requestID {
-		return fmt.Errorf("invalid response ID generated: original=%d, response=%d", requestID, responseID)
+	if !p.acceptRequest(f.id, cancel) {
+		cancel()
+		return nil, false
 	}
 
-	totalLength := uint32(len(payload) + 4)
-	s := p.Stream
-	if err := binary.Write(s, binary.BigEndian, totalLength); err != nil {
-		return err
+	if f.header != nil {
+		ctx = metadata.NewIncomingContext(ctx, f.header)
+	}
+	call := &handlerCall{compressor: p.compressor, codec: requestCodec(f)}
+	if f.compressor != "" {
+		call.compressor = f.compressor
 	}
+	return context.WithValue(ctx, handlerCallKey{}, call), true
+}
 
-	if err := binary.Write(s, binary.BigEndian, responseID); err != nil {
-		return err
+// cancelRequest cancels the context of the in-flight request with the given
+// ID, if any.
+func (p *RpcPeer) cancelRequest(requestID uint32) {
+	p.mu.Lock()
+	cancel, ok := p.inflight[requestID]
+	p.mu.Unlock()
+
+	if ok {
+		cancel()
 	}
+}
 
-	_, err := s.Write(payload)
-	return err
+// finishRequest releases the context, and the stream if any, registered for
+// requestID.
+func (p *RpcPeer) finishRequest(requestID uint32) {
+	p.mu.Lock()
+	cancel, ok := p.inflight[requestID]
+	delete(p.inflight, requestID)
+	delete(p.remoteStreams, requestID)
+	p.checkDrained()
+	p.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
 }
 
-func (p *RpcPeer) handleRequest(requestID uint32, methodName string, payload []byte) {
-	parts := strings.Split(methodName, ".")
-	if len(parts) != 2 {
-		p.writeErrorResponse(requestID, ErrorCodeInvalidRequest, "invalid method name format")
+// handleRequest dispatches a request or stream open frame to the registered
+// service method. stream is the accepted stream for streaming calls.
+func (p *RpcPeer) handleRequest(ctx context.Context, f *frame, stream *rpcStream) {
+	requestID := f.id
+	defer p.finishRequest(requestID)
+
+	// A panicking handler fails its own call only, not the process.
+	defer func() {
+		if v := recover(); v != nil {
+			err := p.recovered(f.method, v)
+			if stream != nil {
+				p.endStream(requestID, stream, err)
+			} else {
+				p.writeHandlerError(ctx, requestID, err)
+			}
+		}
+	}()
+
+	if stream != nil {
+		stream.announceWindow()
+	}
+
+	cdc := handlerCallFrom(ctx).codec
+	if cdc == nil {
+		p.writeErrorResponse(ctx, requestID, status.Unimplemented, fmt.Sprintf("codec %s not supported", f.codec))
 		return
 	}
 
-	serviceName, methodName := parts[0], parts[1]
-	service, ok := p.services[serviceName]
-	if !ok {
-		p.writeErrorResponse(requestID, ErrorCodeMethodNotFound, fmt.Sprintf("service %s not found", serviceName))
+	serviceName, methodName, ok := strings.Cut(f.method, ".")
+	if !ok || strings.Contains(methodName, ".") {
+		p.writeErrorResponse(ctx, requestID, status.InvalidArgument, "invalid method name format")
 		return
 	}
 
-	serviceValue := reflect.ValueOf(service)
-	method := serviceValue.MethodByName(methodName)
-	if !method.IsValid() {
-		p.writeErrorResponse(requestID, ErrorCodeMethodNotFound, fmt.Sprintf("method %s not found", methodName))
+	svc, ok := p.services[serviceName]
+	if !ok {
+		p.writeErrorResponse(ctx, requestID, status.Unimplemented, fmt.Sprintf("service %s not found", serviceName))
 		return
 	}
 
-	// Create the appropriate request message type
-	methodType := method.Type()
-	if methodType.NumIn() != 2 { // Context and request message
-		p.writeErrorResponse(requestID, ErrorCodeInvalidRequest, "invalid method signature")
+	desc, err := svc.method(f.method, methodName)
+	if err != nil {
+		p.writeHandlerError(ctx, requestID, err)
 		return
 	}
 
-	// Create and unmarshal the request message
-	requestMsgType := methodType.In(1).Elem()
-	requestMsg := reflect.New(requestMsgType).Interface().(proto.Message)
-	if err := proto.Unmarshal(payload, requestMsg); err != nil {
-		p.writeErrorResponse(requestID, ErrorCodeInternalError, fmt.Sprintf("failed to unmarshal request: %v", err))
+	kind := desc.kind()
+	if requested := requestedMethodKind(f); kind != requested {
+		p.writeErrorResponse(ctx, requestID, status.InvalidArgument, fmt.Sprintf("method %s is %s, not %s", methodName, kind, requested))
 		return
 	}
 
-	// Call the method with the context containing the session
-	results := method.Call([]reflect.Value{
-		reflect.ValueOf(p.ctx),
-		reflect.ValueOf(requestMsg),
-	})
+	if kind != unaryMethod {
+		p.handleStream(f, svc.impl, desc.StreamHandler, kind, stream)
+		return
+	}
 
-	if len(results) != 1 {
-		p.writeErrorResponse(requestID, ErrorCodeInternalError, "invalid method return values")
+	dec := func(req interface{}) error {
+		if err := cdc.Unmarshal(f.payload, req); err != nil {
+			return status.Errorf(status.Internal, "failed to unmarshal request: %v", err)
+		}
+		return nil
+	}
+	response, err := desc.Handler(svc.impl, ctx, dec, p.unaryInterceptor)
+	f.release()
+	if ctx.Err() != nil {
+		// The deadline passed or the caller cancelled the call; nobody is
+		// waiting for the reply any more.
+		return
+	}
+	if err != nil {
+		p.writeHandlerError(ctx, requestID, err)
+		return
+	}
+	if isNilMessage(response) {
+		p.writeErrorResponse(ctx, requestID, status.Internal, fmt.Sprintf("method %s returned no response", methodName))
 		return
 	}
 
 	// Marshal the response
-	response := results[0].Interface().(proto.Message)
-	responseBytes, err := proto.Marshal(response)
+	responseBytes, err := cdc.Marshal(response)
 	if err != nil {
-		p.writeErrorResponse(requestID, ErrorCodeInternalError, fmt.Sprintf("failed to marshal response: %v", err))
+		p.writeErrorResponse(ctx, requestID, status.Internal, fmt.Sprintf("failed to marshal response: %v", err))
+		return
+	}
+	if err := p.checkSendSize(len(responseBytes)); err != nil {
+		p.writeHandlerError(ctx, requestID, err)
 		return
 	}
 
-	p.writeResponse(requestID, responseBytes)
+	if err := p.writeResponse(ctx, requestID, responseBytes); status.CodeOf(err) == status.ResourceExhausted {
+		// Too large for the remote end; nothing was written, so the caller
+		// can still be told.
+		p.writeHandlerError(ctx, requestID, err)
+	}
 }
 
+// Close closes the peer and its stream immediately. Requests being handled
+// are cancelled and calls waiting for a response fail with ErrPeerClosed;
+// use Shutdown to let them finish first.
 func (p *RpcPeer) Close() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.closed = true
+	p.mu.Unlock()
 
 	if p.cancel != nil {
 		p.cancel()
 	}
+	p.failCalls(ErrPeerClosed, allCalls)
 
-	for _, ch := range p.pendingCalls {
-		close(ch)
+	err := p.Stream.Close()
+	if p.writeDone != nil {
+		// Once Close returns, frames are refused rather than queued for a
+		// write loop that is gone.
+		<-p.writeDone
 	}
-	p.pendingCalls = make(map[uint32]chan []byte)
-
-	return p.Stream.Close()
+	return err
 }
 
 func (p *RpcPeer) Wait() error {
@@ -374,65 +861,123 @@ func (p *RpcPeer) ErrorChannel() <-chan error {
 	return p.errChan
 }
 
-var ErrNotImplemented = errors.New("method not implemented")
+// ErrNotImplemented is returned by the generated Unimplemented servers. It
+// reaches the caller with status.Unimplemented.
+var ErrNotImplemented = status.Errorf(status.Unimplemented, "method not implemented")
 
-// ErrorCode represents different types of framework-level errors
-type ErrorCode uint32
+// ErrorCode is the code of a failed call.
+//
+// Deprecated: Use status.Code.
+type ErrorCode = status.Code
 
+// Framework error codes, kept for compatibility. They map onto the canonical
+// codes of the status package.
+//
+// Deprecated: Use the codes of the status package.
 const (
-	ErrorCodeUnknown ErrorCode = iota
-	ErrorCodeMethodNotFound
-	ErrorCodeInvalidRequest
-	ErrorCodeMalformedRequest
-	ErrorCodeInvalidMessageFormat
-	ErrorCodeInternalError
+	ErrorCodeUnknown              = status.Unknown
+	ErrorCodeMethodNotFound       = status.Unimplemented
+	ErrorCodeInvalidRequest       = status.InvalidArgument
+	ErrorCodeMalformedRequest     = status.InvalidArgument
+	ErrorCodeInvalidMessageFormat = status.InvalidArgument
+	ErrorCodeInternalError        = status.Internal
 )
 
-// RPCError represents a framework-level RPC error
-type RPCError struct {
-	Code    ErrorCode
-	Message string
-}
+// RPCError is the error a caller receives when a call fails.
+//
+// Deprecated: Use status.Error, which RPCError is an alias of, and create
+// errors with status.Errorf or Status.Err.
+type RPCError = status.Error
 
-func (e *RPCError) Error() string {
-	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+func (p *RpcPeer) writeErrorResponse(ctx context.Context, requestID uint32, code status.Code, message string) error {
+	return p.writeRPCError(ctx, requestID, &RPCError{Code: code, Message: message})
 }
 
-func (p *RpcPeer) writeErrorResponse(requestID uint32, code ErrorCode, message string) error {
-	p.writeMu.Lock()
-	defer p.writeMu.Unlock()
+// writeRPCError sends rpcErr as the error response to requestID, along with
+// the header and trailer the handler has set.
+func (p *RpcPeer) writeRPCError(ctx context.Context, requestID uint32, rpcErr *RPCError) error {
+	body, err := marshalRPCError(rpcErr)
+	if err != nil {
+		body, _ = marshalRPCError(&RPCError{
+			Code:    status.Internal,
+			Message: fmt.Sprintf("failed to marshal error details: %v", err),
+		})
+	}
 
-	messageBytes := []byte(message)
-	totalLength := uint32(4 + len(messageBytes))
-	responseID := (requestID & RequestIDMask) | RequestIDMSB | uint32(0x40000000)
+	responseID := (requestID & RequestIDMask) | RequestIDMSB
+	return p.writeReply(ctx, responseID, frameError, body, true)
+}
 
-	s := p.Stream
-	if err := binary.Write(s, binary.BigEndian, totalLength); err != nil {
-		return err
+// writeHandlerError reports an error returned by a handler to the caller.
+// A status error is sent as is; any other error is reported as
+// status.Unknown with the error text as message.
+func (p *RpcPeer) writeHandlerError(ctx context.Context, requestID uint32, err error) error {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return p.writeRPCError(ctx, requestID, rpcErr)
 	}
+	return p.writeErrorResponse(ctx, requestID, status.Unknown, err.Error())
+}
 
-	if err := binary.Write(s, binary.BigEndian, responseID); err != nil {
-		return err
+// marshalRPCError encodes the body of an error frame:
+// [code][message length][message] followed by [length][detail] for each
+// detail.
+func marshalRPCError(rpcErr *RPCError) ([]byte, error) {
+	body := binary.BigEndian.AppendUint32(nil, uint32(rpcErr.Code))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(rpcErr.Message)))
+	body = append(body, rpcErr.Message...)
+
+	for _, detail := range rpcErr.Details {
+		detailBytes, err := proto.Marshal(detail)
+		if err != nil {
+			return nil, err
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(len(detailBytes)))
+		body = append(body, detailBytes...)
 	}
+	return body, nil
+}
 
-	if err := binary.Write(s, binary.BigEndian, uint32(code)); err != nil {
-		return err
+// callError returns the error carried by an error frame. A malformed frame
+// is reported as status.Internal, so callers always receive a *status.Error.
+func (p *RpcPeer) callError(f *frame) error {
+	rpcErr, err := p.readErrorResponse(f.payload)
+	if err != nil {
+		return status.Errorf(status.Internal, "malformed error response: %v", err)
 	}
-
-	_, err := s.Write(messageBytes)
-	return err
+	return rpcErr
 }
 
 func (p *RpcPeer) readErrorResponse(payload []byte) (*RPCError, error) {
-	if len(payload) < 4 {
+	if len(payload) < 8 {
 		return nil, fmt.Errorf("error payload too short")
 	}
 
-	errorCode := ErrorCode(binary.BigEndian.Uint32(payload[:4]))
-	message := string(payload[4:])
+	rpcErr := &RPCError{Code: status.Code(binary.BigEndian.Uint32(payload[:4]))}
+	messageLen := binary.BigEndian.Uint32(payload[4:8])
+	payload = payload[8:]
+	if uint32(len(payload)) < messageLen {
+		return nil, fmt.Errorf("error message truncated")
+	}
+	rpcErr.Message = string(payload[:messageLen])
+	payload = payload[messageLen:]
+
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("error detail truncated")
+		}
+		detailLen := binary.BigEndian.Uint32(payload[:4])
+		payload = payload[4:]
+		if uint32(len(payload)) < detailLen {
+			return nil, fmt.Errorf("error detail truncated")
+		}
+		detail := &anypb.Any{}
+		if err := proto.Unmarshal(payload[:detailLen], detail); err != nil {
+			return nil, fmt.Errorf("invalid error detail: %v", err)
+		}
+		rpcErr.Details = append(rpcErr.Details, detail)
+		payload = payload[detailLen:]
+	}
 
-	return &RPCError{
-		Code:    errorCode,
-		Message: message,
-	}, nil
+	return rpcErr, nil
 }
@@ -2,11 +2,23 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/jibuji/go-stream-rpc/rpc/metadata"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
 	"github.com/jibuji/go-stream-rpc/session"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // MockStream implements Stream interface for testing
@@ -16,6 +28,7 @@ type MockStream struct {
 	readErr   error
 	writeErr  error
 	closed    bool
+	done      chan struct{} // closed by Close
 	mu        sync.Mutex
 }
 
@@ -23,6 +36,7 @@ func NewMockStream() *MockStream {
 	return &MockStream{
 		readData:  make([]byte, 0),
 		writeData: make([]byte, 0),
+		done:      make(chan struct{}),
 	}
 }
 
@@ -35,6 +49,10 @@ func (m *MockStream) Read(p []byte) (n int, err error) {
 	}
 
 	if len(m.readData) == 0 {
+		// Like an idle connection, block until the stream is closed.
+		m.mu.Unlock()
+		<-m.done
+		m.mu.Lock()
 		return 0, io.EOF
 	}
 
@@ -58,7 +76,10 @@ func (m *MockStream) Write(p []byte) (n int, err error) {
 func (m *MockStream) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.closed = true
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
 	return nil
 }
 
@@ -268,7 +289,7 @@ func TestRpcPeer_Close(t *testing.T) {
 	peer := NewRpcPeer(stream)
 
 	// Create a pending call
-	peer.pendingCalls[1] = make(chan []byte, 1)
+	peer.pendingCalls[1] = make(chan *frame, 1)
 
 	err := peer.Close()
 	if err != nil {
@@ -284,4 +305,2815 @@ func TestRpcPeer_Close(t *testing.T) {
 	}
 }
 
+func TestRpcPeer_CallContext(t *testing.T) {
+	t.Run("deadline exceeded", func(t *testing.T) {
+		peer := NewRpcPeer(NewMockStream())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := peer.CallContext(ctx, "Calculator.Add", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CallContext error = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		if len(peer.pendingCalls) != 0 {
+			t.Error("Pending call not removed after deadline")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		peer := NewRpcPeer(NewMockStream())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+
+		err := peer.CallContext(ctx, "Calculator.Add", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("CallContext error = %v, want %v", err, context.Canceled)
+		}
+
+		if len(peer.pendingCalls) != 0 {
+			t.Error("Pending call not removed after cancellation")
+		}
+	})
+
+	t.Run("already cancelled", func(t *testing.T) {
+		stream := NewMockStream()
+		peer := NewRpcPeer(stream)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := peer.CallContext(ctx, "Calculator.Add", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("CallContext error = %v, want %v", err, context.Canceled)
+		}
+
+		if len(stream.writeData) != 0 {
+			t.Error("Request written for an already cancelled context")
+		}
+	})
+}
+
+func TestRpcPeer_CallTimeout(t *testing.T) {
+	peer := NewRpcPeer(NewMockStream(), WithCallTimeout(20*time.Millisecond))
+
+	err := peer.Call("Calculator.Add", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Call error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// newPipePeers connects two peers over an in-memory pipe. The Stream of each
+// peer is a *countingConn counting the bytes that peer writes.
+func newPipePeers(t *testing.T, clientOpts []RpcPeerOption, serverOpts []RpcPeerOption) (*RpcPeer, *RpcPeer) {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	client := NewRpcPeer(&countingConn{Conn: c1}, clientOpts...)
+	server := NewRpcPeer(&countingConn{Conn: c2}, serverOpts...)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// blockingService blocks every call until the request context is done and
+// reports how it ended.
+type blockingService struct {
+	deadline chan time.Time
+	done     chan error
+}
+
+func newBlockingService() *blockingService {
+	return &blockingService{
+		deadline: make(chan time.Time, 1),
+		done:     make(chan error, 1),
+	}
+}
+
+func (s *blockingService) Wait(ctx context.Context, req *wrapperspb.Int32Value) *wrapperspb.Int32Value {
+	deadline, _ := ctx.Deadline()
+	s.deadline <- deadline
+	<-ctx.Done()
+	s.done <- ctx.Err()
+	return req
+}
+
+func TestRpcPeer_DeadlinePropagation(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	service := newBlockingService()
+	server.RegisterService("Blocking", service)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	want, _ := ctx.Deadline()
+
+	err := client.CallContext(ctx, "Blocking.Wait", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CallContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case got := <-service.deadline:
+		if got.IsZero() {
+			t.Fatal("Handler context has no deadline")
+		}
+		if diff := got.Sub(want); diff < -50*time.Millisecond || diff > 50*time.Millisecond {
+			t.Errorf("Handler deadline off by %v", diff)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler not invoked")
+	}
+
+	select {
+	case err := <-service.done:
+		if err == nil {
+			t.Error("Handler context finished without error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler context not cancelled after deadline")
+	}
+}
+
+func TestRpcPeer_CallTimeoutOption(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	service := newBlockingService()
+	server.RegisterService("Blocking", service)
+
+	start := time.Now()
+	err := client.CallContext(context.Background(), "Blocking.Wait", wrapperspb.Int32(1), &wrapperspb.Int32Value{}, CallTimeout(100*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CallContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CallContext returned after %v", elapsed)
+	}
+
+	select {
+	case got := <-service.deadline:
+		if got.IsZero() {
+			t.Error("Handler context has no deadline")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler not invoked")
+	}
+}
+
+func TestRpcPeer_CancelPropagation(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	service := newBlockingService()
+	server.RegisterService("Blocking", service)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.CallContext(ctx, "Blocking.Wait", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+	}()
+
+	select {
+	case deadline := <-service.deadline:
+		if !deadline.IsZero() {
+			t.Errorf("Handler context has unexpected deadline %v", deadline)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler not invoked")
+	}
+	cancel()
+
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("CallContext error = %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case err := <-service.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Handler context error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler context not cancelled by caller")
+	}
+
+	waitFor(t, "in-flight request released", func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.inflight) == 0
+	})
+}
+
+// counterService streams back the numbers below the requested value.
+type counterService struct{}
+
+func (s *counterService) Count(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	for i := int32(0); i < req.Value; i++ {
+		if err := stream.Send(wrapperspb.Int32(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *counterService) Fail(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	if err := stream.Send(wrapperspb.Int32(0)); err != nil {
+		return err
+	}
+	return &RPCError{Code: ErrorCodeInvalidRequest, Message: "bad count"}
+}
+
+func (s *counterService) Forever(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *counterService) Unary(ctx context.Context, req *wrapperspb.Int32Value) *wrapperspb.Int32Value {
+	return req
+}
+
+func TestRpcPeer_CallStream(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	server.RegisterService("Counter", &counterService{})
+
+	t.Run("all messages then EOF", func(t *testing.T) {
+		stream, err := client.CallStream(context.Background(), "Counter.Count", wrapperspb.Int32(5))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		for want := int32(0); want < 5; want++ {
+			msg := &wrapperspb.Int32Value{}
+			if err := stream.Recv(msg); err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			if msg.Value != want {
+				t.Errorf("Recv got %d, want %d", msg.Value, want)
+			}
+		}
+
+		if err := stream.Recv(&wrapperspb.Int32Value{}); err != io.EOF {
+			t.Errorf("Recv at end got %v, want io.EOF", err)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		stream, err := client.CallStream(context.Background(), "Counter.Fail", wrapperspb.Int32(1))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		if err := stream.Recv(&wrapperspb.Int32Value{}); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+
+		err = stream.Recv(&wrapperspb.Int32Value{})
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Fatalf("Recv error = %v, want *RPCError", err)
+		}
+		if rpcErr.Code != ErrorCodeInvalidRequest || rpcErr.Message != "bad count" {
+			t.Errorf("Recv error = %v", rpcErr)
+		}
+	})
+
+	t.Run("unary method", func(t *testing.T) {
+		stream, err := client.CallStream(context.Background(), "Counter.Unary", wrapperspb.Int32(1))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		var rpcErr *RPCError
+		if err := stream.Recv(&wrapperspb.Int32Value{}); !errors.As(err, &rpcErr) {
+			t.Errorf("Recv error = %v, want *RPCError", err)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := client.CallStream(ctx, "Counter.Forever", wrapperspb.Int32(1))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		waitFor(t, "handler started", func() bool {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			return len(server.inflight) == 1
+		})
+		cancel()
+
+		if err := stream.Recv(&wrapperspb.Int32Value{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("Recv error = %v, want %v", err, context.Canceled)
+		}
+
+		waitFor(t, "handler cancelled", func() bool {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			return len(server.inflight) == 0
+		})
+		waitFor(t, "stream released", func() bool {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return len(client.streams) == 0
+		})
+	})
+}
+
+// bidiService exercises client- and bidi-streaming handlers.
+type bidiService struct{}
+
+func (s *bidiService) Echo(ctx context.Context, stream BidiStream) error {
+	for {
+		msg := &wrapperspb.Int32Value{}
+		if err := stream.Recv(msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *bidiService) Sum(ctx context.Context, stream BidiStream) error {
+	var sum int32
+	for {
+		msg := &wrapperspb.Int32Value{}
+		if err := stream.Recv(msg); err == io.EOF {
+			return stream.Send(wrapperspb.Int32(sum))
+		} else if err != nil {
+			return err
+		}
+		sum += msg.Value
+	}
+}
+
+func TestRpcPeer_OpenStream(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	server.RegisterService("Bidi", &bidiService{})
+	client.RegisterService("Bidi", &bidiService{})
+
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := client.OpenStream(context.Background(), "Bidi.Sum")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+
+		for i := int32(1); i <= 4; i++ {
+			if err := stream.Send(wrapperspb.Int32(i)); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("CloseSend failed: %v", err)
+		}
+
+		sum := &wrapperspb.Int32Value{}
+		if err := stream.Recv(sum); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if sum.Value != 10 {
+			t.Errorf("Sum got %d, want 10", sum.Value)
+		}
+
+		if err := stream.Recv(&wrapperspb.Int32Value{}); err != io.EOF {
+			t.Errorf("Recv at end got %v, want io.EOF", err)
+		}
+		if err := stream.Send(wrapperspb.Int32(1)); err == nil {
+			t.Error("Send after CloseSend succeeded")
+		}
+	})
+
+	// Both peers serve the same service, so streams work in either direction.
+	for name, caller := range map[string]*RpcPeer{"bidi from client": client, "bidi from server": server} {
+		t.Run(name, func(t *testing.T) {
+			stream, err := caller.OpenStream(context.Background(), "Bidi.Echo")
+			if err != nil {
+				t.Fatalf("OpenStream failed: %v", err)
+			}
+
+			for i := int32(0); i < 3; i++ {
+				if err := stream.Send(wrapperspb.Int32(i)); err != nil {
+					t.Fatalf("Send failed: %v", err)
+				}
+				msg := &wrapperspb.Int32Value{}
+				if err := stream.Recv(msg); err != nil {
+					t.Fatalf("Recv failed: %v", err)
+				}
+				if msg.Value != i {
+					t.Errorf("Echo got %d, want %d", msg.Value, i)
+				}
+			}
+
+			if err := stream.CloseSend(); err != nil {
+				t.Fatalf("CloseSend failed: %v", err)
+			}
+			if err := stream.Recv(&wrapperspb.Int32Value{}); err != io.EOF {
+				t.Errorf("Recv at end got %v, want io.EOF", err)
+			}
+		})
+	}
+
+	t.Run("wrong method kind", func(t *testing.T) {
+		server.RegisterService("Counter", &counterService{})
+
+		stream, err := client.OpenStream(context.Background(), "Counter.Unary")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+
+		var rpcErr *RPCError
+		if err := stream.Recv(&wrapperspb.Int32Value{}); !errors.As(err, &rpcErr) || rpcErr.Code != ErrorCodeInvalidRequest {
+			t.Errorf("Recv error = %v, want ErrorCodeInvalidRequest", err)
+		}
+	})
+
+	waitFor(t, "streams released", func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(client.streams) == 0 && len(server.remoteStreams) == 0 &&
+			len(server.streams) == 0 && len(client.remoteStreams) == 0
+	})
+}
+
+// floodService streams 1 KiB messages as fast as the caller lets it.
+type floodService struct {
+	sent atomic.Int32
+}
+
+func (s *floodService) Flood(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	chunk := make([]byte, 1024)
+	for i := int32(0); i < req.Value; i++ {
+		if err := stream.Send(wrapperspb.Bytes(chunk)); err != nil {
+			return err
+		}
+		s.sent.Add(1)
+	}
+	return nil
+}
+
+// Stall never reads the stream, leaving the caller's messages queued.
+func (s *floodService) Stall(ctx context.Context, stream BidiStream) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRpcPeer_FlowControl(t *testing.T) {
+	const messages = 200
+
+	drain := func(t *testing.T, stream ClientStream) {
+		for i := 0; i < messages; i++ {
+			if err := stream.Recv(&wrapperspb.BytesValue{}); err != nil {
+				t.Fatalf("Recv %d failed: %v", i, err)
+			}
+		}
+		if err := stream.Recv(&wrapperspb.BytesValue{}); err != io.EOF {
+			t.Errorf("Recv at end got %v, want io.EOF", err)
+		}
+	}
+
+	t.Run("slow consumer", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		service := &floodService{}
+		server.RegisterService("Flood", service)
+
+		stream, err := client.CallStream(context.Background(), "Flood.Flood", wrapperspb.Int32(messages))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		// The handler fills the default window and then has to wait.
+		waitFor(t, "window filled", func() bool { return service.sent.Load() >= 60 })
+		time.Sleep(50 * time.Millisecond)
+		if sent := service.sent.Load(); sent > DefaultInitialWindowSize/1024+1 {
+			t.Errorf("handler sent %d messages without the caller reading", sent)
+		}
+
+		drain(t, stream)
+	})
+
+	t.Run("larger window", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithInitialWindowSize(512 * 1024)}, nil)
+		service := &floodService{}
+		server.RegisterService("Flood", service)
+
+		stream, err := client.CallStream(context.Background(), "Flood.Flood", wrapperspb.Int32(messages))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		waitFor(t, "all messages sent", func() bool { return service.sent.Load() == messages })
+		drain(t, stream)
+	})
+
+	t.Run("sender ignoring the window", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Flood", &floodService{})
+
+		stream, err := client.OpenStream(context.Background(), "Flood.Stall")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		// Pretend the handler granted far more than it did.
+		stream.(*rpcStream).addSendWindow(1 << 30)
+
+		chunk := wrapperspb.Bytes(make([]byte, 1024))
+		for i := 0; i < messages; i++ {
+			if err := stream.Send(chunk); err != nil {
+				break
+			}
+		}
+		if err := stream.Recv(&wrapperspb.BytesValue{}); status.CodeOf(err) != status.ResourceExhausted {
+			t.Errorf("Recv error = %v, want ResourceExhausted", err)
+		}
+	})
+}
+
+// validatingService fails requests for non-positive numbers.
+type validatingService struct{}
+
+func (s *validatingService) Check(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	switch {
+	case req.Value < 0:
+		detail, err := anypb.New(req)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &RPCError{Code: ErrorCodeInvalidRequest, Message: "negative value", Details: []*anypb.Any{detail}}
+	case req.Value == 0:
+		return nil, errors.New("zero value")
+	}
+	return req, nil
+}
+
+func (s *validatingService) Find(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	st, err := status.Newf(status.NotFound, "item %d not found", req.Value).WithDetails(req)
+	if err != nil {
+		return nil, err
+	}
+	return nil, st.Err()
+}
+
+func (s *validatingService) Nothing(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	return nil, nil
+}
+
+func TestRpcPeer_HandlerErrors(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	server.RegisterService("Validating", &validatingService{})
+
+	t.Run("success", func(t *testing.T) {
+		resp := &wrapperspb.Int32Value{}
+		if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(3), resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != 3 {
+			t.Errorf("Response got %d, want 3", resp.Value)
+		}
+	})
+
+	t.Run("rpc error with details", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(-1), &wrapperspb.Int32Value{})
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			t.Fatalf("CallContext error = %v, want *RPCError", err)
+		}
+		if rpcErr.Code != ErrorCodeInvalidRequest || rpcErr.Message != "negative value" {
+			t.Errorf("Error got %d %q, want %d %q", rpcErr.Code, rpcErr.Message, ErrorCodeInvalidRequest, "negative value")
+		}
+		if len(rpcErr.Details) != 1 {
+			t.Fatalf("Error has %d details, want 1", len(rpcErr.Details))
+		}
+		detail := &wrapperspb.Int32Value{}
+		if err := rpcErr.Details[0].UnmarshalTo(detail); err != nil {
+			t.Fatalf("UnmarshalTo failed: %v", err)
+		}
+		if !proto.Equal(detail, wrapperspb.Int32(-1)) {
+			t.Errorf("Detail got %v, want -1", detail)
+		}
+	})
+
+	t.Run("status error", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Validating.Find", wrapperspb.Int32(7), &wrapperspb.Int32Value{})
+		st, ok := status.FromError(err)
+		if !ok {
+			t.Fatalf("CallContext error = %v, want a status error", err)
+		}
+		if st.Code() != status.NotFound || st.Message() != "item 7 not found" {
+			t.Errorf("Status got %v %q", st.Code(), st.Message())
+		}
+		details := st.Details()
+		if len(details) != 1 {
+			t.Fatalf("Status has %d details, want 1", len(details))
+		}
+		if msg, ok := details[0].(proto.Message); !ok || !proto.Equal(msg, wrapperspb.Int32(7)) {
+			t.Errorf("Detail got %v, want 7", details[0])
+		}
+	})
+
+	t.Run("plain error", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(0), &wrapperspb.Int32Value{})
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != ErrorCodeUnknown || rpcErr.Message != "zero value" {
+			t.Errorf("CallContext error = %v, want ErrorCodeUnknown with handler message", err)
+		}
+	})
+
+	t.Run("nil response", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Validating.Nothing", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != ErrorCodeInternalError {
+			t.Errorf("CallContext error = %v, want ErrorCodeInternalError", err)
+		}
+	})
+}
+
+// brokenService provokes framework errors.
+type brokenService struct{}
+
+func (s *brokenService) Echo(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return req, nil
+}
+
+// Garbage returns bytes that are not valid UTF-8, so they cannot be decoded
+// as a StringValue.
+func (s *brokenService) Garbage(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	return wrapperspb.Bytes([]byte{0xff}), nil
+}
+
+func (s *brokenService) Bad(n int) int {
+	return n
+}
+
+func TestRpcPeer_FrameworkErrors(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	server.RegisterService("Broken", &brokenService{})
+
+	tests := []struct {
+		name     string
+		method   string
+		request  proto.Message
+		response proto.Message
+		code     status.Code
+	}{
+		{"service not found", "Missing.Echo", wrapperspb.String("x"), &wrapperspb.StringValue{}, status.Unimplemented},
+		{"method not found", "Broken.Missing", wrapperspb.String("x"), &wrapperspb.StringValue{}, status.Unimplemented},
+		{"invalid method name", "Broken", wrapperspb.String("x"), &wrapperspb.StringValue{}, status.InvalidArgument},
+		{"bad signature", "Broken.Bad", wrapperspb.String("x"), &wrapperspb.StringValue{}, status.InvalidArgument},
+		{"request unmarshal failure", "Broken.Echo", wrapperspb.Bytes([]byte{0xff}), &wrapperspb.StringValue{}, status.Internal},
+		{"response unmarshal failure", "Broken.Garbage", wrapperspb.Bytes(nil), &wrapperspb.StringValue{}, status.Internal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err := client.CallContext(ctx, tt.method, tt.request, tt.response)
+			var rpcErr *RPCError
+			if !errors.As(err, &rpcErr) {
+				t.Fatalf("CallContext error = %v, want *RPCError", err)
+			}
+			if rpcErr.Code != tt.code {
+				t.Errorf("Error code = %v, want %v (%s)", rpcErr.Code, tt.code, rpcErr.Message)
+			}
+		})
+	}
+
+	t.Run("malformed error frame", func(t *testing.T) {
+		err := client.callError(&frame{typ: frameError, payload: []byte{0, 0}})
+		if code := status.CodeOf(err); code != status.Internal {
+			t.Errorf("Error code = %v, want %v", code, status.Internal)
+		}
+	})
+
+	// The connection survives framework errors.
+	resp := &wrapperspb.StringValue{}
+	if err := client.CallContext(context.Background(), "Broken.Echo", wrapperspb.String("ok"), resp); err != nil {
+		t.Fatalf("CallContext after errors failed: %v", err)
+	}
+	if resp.Value != "ok" {
+		t.Errorf("Echo got %q, want %q", resp.Value, "ok")
+	}
+}
+
+// newRawHandshakePeer returns a peer with the handshake enabled whose remote
+// end answers with the given raw preface and then keeps draining the
+// connection.
+func newRawHandshakePeer(t *testing.T, remote []byte) *RpcPeer {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	peer := NewRpcPeer(c1, WithHandshakeTimeout(time.Second))
+	t.Cleanup(func() {
+		peer.Close()
+		c2.Close()
+	})
+
+	go func() {
+		if _, err := readPreface(c2); err != nil {
+			return
+		}
+		go io.Copy(io.Discard, c2)
+		c2.Write(remote)
+	}()
+	return peer
+}
+
+func TestRpcPeer_Handshake(t *testing.T) {
+	t.Run("both ends", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithHandshake()}, []RpcPeerOption{WithHandshake()})
+		server.RegisterService("Broken", &brokenService{})
+
+		if err := client.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		if got := client.Features(); got != supportedFeatures {
+			t.Errorf("Features() = %b, want %b", got, supportedFeatures)
+		}
+
+		resp := &wrapperspb.StringValue{}
+		if err := client.CallContext(context.Background(), "Broken.Echo", wrapperspb.String("hi"), resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != "hi" {
+			t.Errorf("Echo got %q, want %q", resp.Value, "hi")
+		}
+	})
+
+	t.Run("remote without handshake", func(t *testing.T) {
+		client, _ := newPipePeers(t, []RpcPeerOption{WithHandshakeTimeout(100 * time.Millisecond)}, nil)
+
+		err := client.CallContext(context.Background(), "Broken.Echo", wrapperspb.String("hi"), &wrapperspb.StringValue{})
+		if err == nil {
+			t.Fatal("CallContext succeeded without a remote handshake")
+		}
+		if werr := <-client.ErrorChannel(); werr == nil {
+			t.Error("ErrorChannel reported no handshake error")
+		}
+	})
+
+	t.Run("not a preface", func(t *testing.T) {
+		peer := newRawHandshakePeer(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+		if err := peer.Handshake(context.Background()); !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("Handshake error = %v, want ErrIncompatiblePeer", err)
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		remote := &preface{version: 0, features: supportedFeatures, maxFrameSize: MaxMessageSize}
+		peer := newRawHandshakePeer(t, remote.marshal())
+		if err := peer.Handshake(context.Background()); !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("Handshake error = %v, want ErrIncompatiblePeer", err)
+		}
+	})
+
+	t.Run("deadlines not negotiated", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		peer := NewRpcPeer(c1, WithHandshake())
+		t.Cleanup(func() {
+			peer.Close()
+			c2.Close()
+		})
+
+		flags := make(chan uint8, 1)
+		go func() {
+			if _, err := readPreface(c2); err != nil {
+				return
+			}
+			remote := &preface{version: ProtocolVersion, features: supportedFeatures &^ FeatureDeadlines, maxFrameSize: MaxMessageSize}
+			c2.Write(remote.marshal())
+			var header [4 + frameHeaderSize]byte
+			if _, err := io.ReadFull(c2, header[:]); err == nil {
+				flags <- header[9]
+			}
+			io.Copy(io.Discard, c2)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		peer.CallContext(ctx, "Broken.Echo", wrapperspb.String("hi"), &wrapperspb.StringValue{})
+		select {
+		case f := <-flags:
+			if f&flagTimeout != 0 {
+				t.Error("Request carries a timeout the remote end did not announce support for")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No request written")
+		}
+	})
+
+	t.Run("negotiated limits", func(t *testing.T) {
+		remote := &preface{
+			version:      ProtocolVersion + 1,
+			features:     0,
+			maxFrameSize: 64,
+			settings:     map[uint8][]byte{200: []byte("ignored")},
+		}
+		peer := newRawHandshakePeer(t, remote.marshal())
+		if err := peer.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		if got := peer.Features(); got != 0 {
+			t.Errorf("Features() = %b, want none", got)
+		}
+
+		if _, err := peer.CallStream(context.Background(), "Counter.Count", wrapperspb.Int32(1)); status.CodeOf(err) != status.Unimplemented {
+			t.Errorf("CallStream error = %v, want Unimplemented", err)
+		}
+
+		err := peer.CallContext(context.Background(), "Broken.Echo", wrapperspb.String(strings.Repeat("x", 100)), &wrapperspb.StringValue{})
+		if status.CodeOf(err) != status.ResourceExhausted {
+			t.Errorf("CallContext error = %v, want ResourceExhausted", err)
+		}
+	})
+}
+
+// metadataService echoes the "token" request metadata and sets a header and
+// a trailer.
+type metadataService struct{}
+
+func (s *metadataService) respond(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if err := SetHeader(ctx, metadata.Pairs("header", "h")); err != nil {
+		return "", err
+	}
+	if err := SetTrailer(ctx, metadata.Pairs("trailer", "t")); err != nil {
+		return "", err
+	}
+	return strings.Join(md.Get("token"), ","), nil
+}
+
+func (s *metadataService) Echo(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	token, err := s.respond(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return wrapperspb.String(token), nil
+}
+
+func (s *metadataService) Fail(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	if _, err := s.respond(ctx); err != nil {
+		return nil, err
+	}
+	return nil, status.Errorf(status.PermissionDenied, "denied")
+}
+
+func (s *metadataService) Stream(ctx context.Context, req *wrapperspb.StringValue, stream ServerStream) error {
+	token, err := s.respond(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(wrapperspb.String(token)); err != nil {
+		return err
+	}
+	if err := SetHeader(ctx, metadata.Pairs("late", "x")); err == nil {
+		return errors.New("SetHeader succeeded after the header was sent")
+	}
+	return nil
+}
+
+func TestRpcPeer_Metadata(t *testing.T) {
+	client, server := newPipePeers(t, nil, nil)
+	server.RegisterService("Metadata", &metadataService{})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "Token", "secret", "token", "second")
+	wantHeader := metadata.Pairs("header", "h")
+	wantTrailer := metadata.Pairs("trailer", "t")
+
+	t.Run("unary", func(t *testing.T) {
+		var header, trailer metadata.MD
+		resp := &wrapperspb.StringValue{}
+		if err := client.CallContext(ctx, "Metadata.Echo", wrapperspb.String(""), resp, Header(&header), Trailer(&trailer)); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != "secret,second" {
+			t.Errorf("Handler saw token %q, want %q", resp.Value, "secret,second")
+		}
+		if !reflect.DeepEqual(header, wantHeader) || !reflect.DeepEqual(trailer, wantTrailer) {
+			t.Errorf("Got header %v and trailer %v", header, trailer)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var header, trailer metadata.MD
+		err := client.CallContext(ctx, "Metadata.Fail", wrapperspb.String(""), &wrapperspb.StringValue{}, Header(&header), Trailer(&trailer))
+		if status.CodeOf(err) != status.PermissionDenied {
+			t.Errorf("CallContext error = %v, want PermissionDenied", err)
+		}
+		if !reflect.DeepEqual(header, wantHeader) || !reflect.DeepEqual(trailer, wantTrailer) {
+			t.Errorf("Got header %v and trailer %v", header, trailer)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var header, trailer metadata.MD
+		stream, err := client.CallStream(ctx, "Metadata.Stream", wrapperspb.String(""), Header(&header), Trailer(&trailer))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+
+		msg := &wrapperspb.StringValue{}
+		if err := stream.Recv(msg); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if msg.Value != "secret,second" {
+			t.Errorf("Handler saw token %q, want %q", msg.Value, "secret,second")
+		}
+		if !reflect.DeepEqual(header, wantHeader) {
+			t.Errorf("Got header %v, want %v", header, wantHeader)
+		}
+
+		if err := stream.Recv(msg); err != io.EOF {
+			t.Fatalf("Recv at end got %v, want io.EOF", err)
+		}
+		if !reflect.DeepEqual(trailer, wantTrailer) {
+			t.Errorf("Got trailer %v, want %v", trailer, wantTrailer)
+		}
+	})
+
+	t.Run("outside a handler", func(t *testing.T) {
+		if err := SetHeader(context.Background(), metadata.Pairs("a", "b")); err == nil {
+			t.Error("SetHeader succeeded outside a handler")
+		}
+	})
+
+	t.Run("key too long", func(t *testing.T) {
+		longKey := strings.Repeat("k", 256)
+		callCtx := metadata.AppendToOutgoingContext(ctx, longKey, "v")
+		err := client.CallContext(callCtx, "Metadata.Echo", wrapperspb.String(""), &wrapperspb.StringValue{})
+		if status.CodeOf(err) != status.InvalidArgument || !strings.Contains(err.Error(), longKey) {
+			t.Errorf("CallContext error = %v, want InvalidArgument naming the key", err)
+		}
+
+		handlerCtx := context.WithValue(ctx, handlerCallKey{}, &handlerCall{})
+		if err := SetHeader(handlerCtx, metadata.Pairs(longKey, "v")); status.CodeOf(err) != status.InvalidArgument {
+			t.Errorf("SetHeader error = %v, want InvalidArgument", err)
+		}
+		if err := SetTrailer(handlerCtx, metadata.Pairs(longKey, "v")); status.CodeOf(err) != status.InvalidArgument {
+			t.Errorf("SetTrailer error = %v, want InvalidArgument", err)
+		}
+	})
+}
+
+// countingStream counts the messages passing through a stream.
+type countingStream struct {
+	BidiStream
+	sent, received *atomic.Int32
+}
+
+func (s *countingStream) Send(msg interface{}) error {
+	s.sent.Add(1)
+	return s.BidiStream.Send(msg)
+}
+
+func (s *countingStream) Recv(msg interface{}) error {
+	err := s.BidiStream.Recv(msg)
+	if err == nil {
+		s.received.Add(1)
+	}
+	return err
+}
+
+func TestRpcPeer_Interceptors(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(format string, a ...interface{}) {
+		mu.Lock()
+		calls = append(calls, fmt.Sprintf(format, a...))
+		mu.Unlock()
+	}
+	recorded := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		c := calls
+		calls = nil
+		return c
+	}
+
+	auth := func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get("token")) == 0 {
+			return nil, status.Errorf(status.Unauthenticated, "missing token")
+		}
+		record("auth %s", info.FullMethod)
+		return handler(ctx, req)
+	}
+	logging := func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		record("log %s %v", info.FullMethod, status.CodeOf(err))
+		return resp, err
+	}
+	var sent, received atomic.Int32
+	counting := func(srv interface{}, stream BidiStream, info *StreamServerInfo, handler StreamHandler) error {
+		record("stream %s client=%t server=%t", info.FullMethod, info.IsClientStream, info.IsServerStream)
+		return handler(srv, &countingStream{stream, &sent, &received})
+	}
+
+	withToken := func(ctx context.Context, method string, req, resp interface{}, invoker UnaryInvoker, opts ...CallOption) error {
+		record("invoke %s", method)
+		return invoker(metadata.AppendToOutgoingContext(ctx, "token", "t"), method, req, resp, opts...)
+	}
+	streamer := func(ctx context.Context, desc *StreamDesc, method string, streamer Streamer, opts ...CallOption) (BidiStream, error) {
+		record("open %s client=%t server=%t", method, desc.ClientStreams, desc.ServerStreams)
+		return streamer(ctx, desc, method, opts...)
+	}
+
+	client, server := newPipePeers(t,
+		[]RpcPeerOption{WithUnaryClientInterceptor(withToken), WithStreamClientInterceptor(streamer)},
+		[]RpcPeerOption{WithUnaryServerInterceptor(auth, logging), WithStreamServerInterceptor(counting)})
+	server.RegisterService("Validating", &validatingService{})
+	server.RegisterService("Counter", &counterService{})
+	server.RegisterService("Bidi", &bidiService{})
+
+	t.Run("unary", func(t *testing.T) {
+		resp := &wrapperspb.Int32Value{}
+		if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(3), resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(0), resp); err == nil {
+			t.Fatal("CallContext succeeded for a failing handler")
+		}
+
+		want := []string{
+			"invoke Validating.Check",
+			"auth Validating.Check",
+			"log Validating.Check OK",
+			"invoke Validating.Check",
+			"auth Validating.Check",
+			"log Validating.Check Unknown",
+		}
+		if got := recorded(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Got calls %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unary rejected", func(t *testing.T) {
+		bare, guarded := newPipePeers(t, nil, []RpcPeerOption{WithUnaryServerInterceptor(auth, logging)})
+		guarded.RegisterService("Validating", &validatingService{})
+
+		err := bare.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(3), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.Unauthenticated {
+			t.Errorf("CallContext error = %v, want Unauthenticated", err)
+		}
+		if got := recorded(); len(got) != 0 {
+			t.Errorf("Rejected call ran %q", got)
+		}
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		sent.Store(0)
+		received.Store(0)
+		stream, err := client.CallStream(context.Background(), "Counter.Count", wrapperspb.Int32(3))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		for {
+			if err := stream.Recv(&wrapperspb.Int32Value{}); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+		}
+
+		if sent.Load() != 3 || received.Load() != 1 {
+			t.Errorf("Interceptor saw %d messages sent and %d received, want 3 and 1", sent.Load(), received.Load())
+		}
+		want := []string{
+			"open Counter.Count client=false server=true",
+			"stream Counter.Count client=false server=true",
+		}
+		if got := recorded(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Got calls %q, want %q", got, want)
+		}
+	})
+
+	t.Run("bidi streaming", func(t *testing.T) {
+		sent.Store(0)
+		received.Store(0)
+		stream, err := client.OpenStream(context.Background(), "Bidi.Sum")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		for i := int32(1); i <= 2; i++ {
+			if err := stream.Send(wrapperspb.Int32(i)); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		stream.CloseSend()
+
+		sum := &wrapperspb.Int32Value{}
+		if err := stream.Recv(sum); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if err := stream.Recv(sum); err != io.EOF {
+			t.Fatalf("Recv at end got %v, want io.EOF", err)
+		}
+
+		if sent.Load() != 1 || received.Load() != 2 {
+			t.Errorf("Interceptor saw %d messages sent and %d received, want 1 and 2", sent.Load(), received.Load())
+		}
+		want := []string{
+			"open Bidi.Sum client=true server=true",
+			"stream Bidi.Sum client=true server=true",
+		}
+		if got := recorded(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Got calls %q, want %q", got, want)
+		}
+	})
+}
+
+type panickingService struct{}
+
+func (s *panickingService) Unary(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	panic("unary")
+}
+
+func (s *panickingService) Stream(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	if err := stream.Send(req); err != nil {
+		return err
+	}
+	panic("stream")
+}
+
+func TestRpcPeer_PanicRecovery(t *testing.T) {
+	panics := make(chan *Panic, 2)
+	client, server := newPipePeers(t, nil, []RpcPeerOption{WithPanicHandler(func(p *Panic) {
+		panics <- p
+	})})
+	server.RegisterService("Panicking", &panickingService{})
+	server.RegisterService("Validating", &validatingService{})
+
+	checkPanic := func(t *testing.T, err error, method string, value interface{}) {
+		t.Helper()
+		if status.CodeOf(err) != status.Internal {
+			t.Errorf("Call error = %v, want Internal", err)
+		}
+
+		select {
+		case p := <-panics:
+			if p.Method != method || p.Value != value || len(p.Stack) == 0 {
+				t.Errorf("Got panic %s %v, want %s %v", p.Method, p.Value, method, value)
+			}
+			if !strings.Contains(err.Error(), p.StackHash) {
+				t.Errorf("Error %q does not contain stack hash %s", err, p.StackHash)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Panic handler not called")
+		}
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Panicking.Unary", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		checkPanic(t, err, "Panicking.Unary", "unary")
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.CallStream(context.Background(), "Panicking.Stream", wrapperspb.Int32(1))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		if err := stream.Recv(&wrapperspb.Int32Value{}); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		checkPanic(t, stream.Recv(&wrapperspb.Int32Value{}), "Panicking.Stream", "stream")
+	})
+
+	t.Run("peer survives", func(t *testing.T) {
+		if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(1), &wrapperspb.Int32Value{}); err != nil {
+			t.Errorf("Call after panics failed: %v", err)
+		}
+	})
+}
+
+// echoServer is the handler type of echoServiceDesc.
+type echoServer interface {
+	Echo(context.Context, *wrapperspb.StringValue) (*wrapperspb.StringValue, error)
+	Count(context.Context, *wrapperspb.Int32Value, ServerStream) error
+}
+
+type echoService struct{}
+
+func (s *echoService) Echo(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return req, nil
+}
+
+func (s *echoService) Count(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	return (&counterService{}).Count(ctx, req, stream)
+}
+
+// Hidden is exported but not part of the service description.
+func (s *echoService) Hidden(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return req, nil
+}
+
+// echoServiceDesc is written the way protoc-gen-stream-rpc generates
+// descriptors.
+var echoServiceDesc = ServiceDesc{
+	ServiceName: "Echo",
+	HandlerType: (*echoServer)(nil),
+	Methods: map[string]MethodDesc{
+		"Echo": {
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error) {
+				req := &wrapperspb.StringValue{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(echoServer).Echo(ctx, req)
+				}
+				info := &UnaryServerInfo{Server: srv, FullMethod: "Echo.Echo"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(echoServer).Echo(ctx, req.(*wrapperspb.StringValue))
+				})
+			},
+		},
+		"Count": {
+			ServerStreams: true,
+			StreamHandler: func(srv interface{}, stream BidiStream) error {
+				req := &wrapperspb.Int32Value{}
+				if err := stream.Recv(req); err != nil {
+					return err
+				}
+				return srv.(echoServer).Count(stream.Context(), req, stream)
+			},
+		},
+	},
+}
+
+func TestRpcPeer_RegisterServiceDesc(t *testing.T) {
+	var intercepted atomic.Int32
+	client, server := newPipePeers(t, nil, []RpcPeerOption{WithUnaryServerInterceptor(
+		func(ctx context.Context, req interface{}, info *UnaryServerInfo, handler UnaryHandler) (interface{}, error) {
+			intercepted.Add(1)
+			return handler(ctx, req)
+		})})
+	server.RegisterServiceDesc(&echoServiceDesc, &echoService{})
+
+	t.Run("unary", func(t *testing.T) {
+		resp := &wrapperspb.StringValue{}
+		if err := client.CallContext(context.Background(), "Echo.Echo", wrapperspb.String("hi"), resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != "hi" {
+			t.Errorf("Echo got %q, want %q", resp.Value, "hi")
+		}
+		if intercepted.Load() != 1 {
+			t.Errorf("Interceptor ran %d times, want 1", intercepted.Load())
+		}
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		stream, err := client.CallStream(context.Background(), "Echo.Count", wrapperspb.Int32(2))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		var n int
+		for {
+			if err := stream.Recv(&wrapperspb.Int32Value{}); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			n++
+		}
+		if n != 2 {
+			t.Errorf("Received %d messages, want 2", n)
+		}
+	})
+
+	t.Run("methods outside the description", func(t *testing.T) {
+		err := client.CallContext(context.Background(), "Echo.Hidden", wrapperspb.String("hi"), &wrapperspb.StringValue{})
+		if status.CodeOf(err) != status.Unimplemented {
+			t.Errorf("CallContext error = %v, want Unimplemented", err)
+		}
+	})
+
+	t.Run("wrong handler type", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("RegisterServiceDesc accepted a handler of the wrong type")
+			}
+		}()
+		server.RegisterServiceDesc(&echoServiceDesc, &counterService{})
+	})
+}
+
+// countingConn counts the bytes written to a connection and the Write calls
+// made on it, each of which is a system call on a socket and a message on a
+// WebSocket.
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+	writes  atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.written.Add(int64(len(p)))
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestRpcPeer_MethodIDs(t *testing.T) {
+	longName := "Validating." + strings.Repeat("x", 300)
+
+	t.Run("negotiated", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithHandshake()}, []RpcPeerOption{WithHandshake()})
+		server.RegisterService("Validating", &validatingService{})
+		conn := client.Stream.(*countingConn)
+
+		if err := client.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		if client.Features()&FeatureMethodIDs == 0 {
+			t.Fatal("Method IDs not negotiated")
+		}
+
+		var sizes []int64
+		for i := 0; i < 3; i++ {
+			before := conn.written.Load()
+			resp := &wrapperspb.Int32Value{}
+			if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(1), resp); err != nil {
+				t.Fatalf("CallContext failed: %v", err)
+			}
+			if resp.Value != 1 {
+				t.Errorf("Check got %d, want 1", resp.Value)
+			}
+			sizes = append(sizes, conn.written.Load()-before)
+		}
+
+		// The first request defines the ID, later ones carry it alone.
+		if saved := sizes[0] - sizes[1]; saved < int64(len("Validating.Check")) {
+			t.Errorf("Request sizes %v: method ID saved %d bytes", sizes, saved)
+		}
+		if sizes[1] != sizes[2] {
+			t.Errorf("Request sizes %v differ after the ID was defined", sizes)
+		}
+
+		// Long names are defined like any other.
+		err := client.CallContext(context.Background(), longName, wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.Unimplemented || !strings.Contains(err.Error(), strings.Repeat("x", 300)) {
+			t.Errorf("CallContext error = %v, want Unimplemented naming the full method", err)
+		}
+	})
+
+	t.Run("legacy name too long", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Validating", &validatingService{})
+
+		err := client.CallContext(context.Background(), longName, wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.InvalidArgument {
+			t.Errorf("CallContext error = %v, want InvalidArgument", err)
+		}
+		if _, err := client.OpenStream(context.Background(), longName); status.CodeOf(err) != status.InvalidArgument {
+			t.Errorf("OpenStream error = %v, want InvalidArgument", err)
+		}
+
+		// Nothing was written, so the connection is still usable.
+		if err := client.CallContext(context.Background(), "Validating.Check", wrapperspb.Int32(1), &wrapperspb.Int32Value{}); err != nil {
+			t.Errorf("CallContext after rejected name failed: %v", err)
+		}
+	})
+}
+
+// echoCompressorService echoes its request and reports the compressor the
+// request arrived with in the header.
+type echoCompressorService struct{}
+
+func (s *echoCompressorService) Echo(ctx context.Context, req *wrapperspb.StringValue) (*wrapperspb.StringValue, error) {
+	return req, nil
+}
+
+func (s *echoCompressorService) Chat(ctx context.Context, stream BidiStream) error {
+	return (&bidiService{}).Echo(ctx, stream)
+}
+
+func TestRpcPeer_Compression(t *testing.T) {
+	large := wrapperspb.String(strings.Repeat("compressible ", 1000))
+	largeSize := int64(proto.Size(large))
+
+	newPeers := func(t *testing.T, clientOpts ...RpcPeerOption) (*RpcPeer, *countingConn, *countingConn) {
+		t.Helper()
+		client, server := newPipePeers(t, clientOpts, []RpcPeerOption{WithHandshake()})
+		server.RegisterService("Echo", &echoCompressorService{})
+		if err := client.Handshake(context.Background()); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		return client, client.Stream.(*countingConn), server.Stream.(*countingConn)
+	}
+
+	// call makes a unary call with the large message and returns the bytes
+	// written by each end.
+	call := func(t *testing.T, client *RpcPeer, clientConn, serverConn *countingConn, opts ...CallOption) (int64, int64) {
+		t.Helper()
+		sent, received := clientConn.written.Load(), serverConn.written.Load()
+		resp := &wrapperspb.StringValue{}
+		if err := client.CallContext(context.Background(), "Echo.Echo", large, resp, opts...); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != large.Value {
+			t.Fatal("Response differs from request")
+		}
+		return clientConn.written.Load() - sent, serverConn.written.Load() - received
+	}
+
+	for _, name := range []string{"gzip", "zstd", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			client, clientConn, serverConn := newPeers(t, WithHandshake(), WithCompressor(name))
+
+			sent, received := call(t, client, clientConn, serverConn)
+			if sent >= largeSize/4 || received >= largeSize/4 {
+				t.Errorf("Sent %d and received %d bytes for a %d byte message", sent, received, largeSize)
+			}
+
+			sent, received = call(t, client, clientConn, serverConn, UseCompressor(""))
+			if sent < largeSize || received < largeSize {
+				t.Errorf("Sent %d and received %d bytes for a %d byte message without compression", sent, received, largeSize)
+			}
+		})
+	}
+
+	t.Run("streams", func(t *testing.T) {
+		client, clientConn, serverConn := newPeers(t, WithHandshake(), WithCompressor("zstd"))
+
+		stream, err := client.OpenStream(context.Background(), "Echo.Chat")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		sent, received := clientConn.written.Load(), serverConn.written.Load()
+		if err := stream.Send(large); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		msg := &wrapperspb.StringValue{}
+		if err := stream.Recv(msg); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if msg.Value != large.Value {
+			t.Fatal("Echo differs from message sent")
+		}
+		// Stream open frames carry no payload, so the handler, which has
+		// no compressor of its own, answers uncompressed.
+		if clientConn.written.Load()-sent >= largeSize/4 {
+			t.Error("Stream message not compressed")
+		}
+		if serverConn.written.Load()-received < largeSize {
+			t.Error("Handler compressed without a compressor")
+		}
+		stream.CloseSend()
+	})
+
+	t.Run("below threshold", func(t *testing.T) {
+		client, clientConn, serverConn := newPeers(t, WithHandshake(), WithCompressor("gzip"), WithCompressionThreshold(int(largeSize)+1))
+
+		if sent, _ := call(t, client, clientConn, serverConn); sent < largeSize {
+			t.Errorf("Message below the threshold sent compressed in %d bytes", sent)
+		}
+	})
+
+	t.Run("not negotiated", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithCompressor("gzip")}, nil)
+		server.RegisterService("Echo", &echoCompressorService{})
+		conn := client.Stream.(*countingConn)
+
+		if err := client.CallContext(context.Background(), "Echo.Echo", large, &wrapperspb.StringValue{}); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if conn.written.Load() < largeSize {
+			t.Error("Message compressed without a handshake")
+		}
+	})
+}
+
+// document is a payload the json codec encodes with encoding/json.
+type document struct {
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
+}
+
+type documentService struct{}
+
+func (s *documentService) Tag(ctx context.Context, req *document) (*document, error) {
+	return &document{Title: req.Title, Tags: append(req.Tags, "seen")}, nil
+}
+
+func (s *documentService) Reverse(ctx context.Context, req *[]byte) (*[]byte, error) {
+	out := make([]byte, len(*req))
+	for i, b := range *req {
+		out[len(out)-1-i] = b
+	}
+	return &out, nil
+}
+
+func (s *documentService) Split(ctx context.Context, req *document, stream ServerStream) error {
+	for _, tag := range req.Tags {
+		if err := stream.Send(&document{Title: req.Title, Tags: []string{tag}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRpcPeer_Codecs(t *testing.T) {
+	client, server := newPipePeers(t, []RpcPeerOption{WithCodec("json")}, nil)
+	server.RegisterService("Documents", &documentService{})
+	server.RegisterService("Broken", &brokenService{})
+	ctx := context.Background()
+
+	t.Run("json", func(t *testing.T) {
+		resp := &document{}
+		if err := client.CallContext(ctx, "Documents.Tag", &document{Title: "a", Tags: []string{"x"}}, resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if want := (&document{Title: "a", Tags: []string{"x", "seen"}}); !reflect.DeepEqual(resp, want) {
+			t.Errorf("Tag got %+v, want %+v", resp, want)
+		}
+	})
+
+	t.Run("protojson", func(t *testing.T) {
+		resp := &wrapperspb.StringValue{}
+		if err := client.CallContext(ctx, "Broken.Echo", wrapperspb.String("hi"), resp); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if resp.Value != "hi" {
+			t.Errorf("Echo got %q, want %q", resp.Value, "hi")
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		var resp []byte
+		if err := client.CallContext(ctx, "Documents.Reverse", []byte("abc"), &resp, UseCodec("bytes")); err != nil {
+			t.Fatalf("CallContext failed: %v", err)
+		}
+		if string(resp) != "cba" {
+			t.Errorf("Reverse got %q, want %q", resp, "cba")
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.CallStream(ctx, "Documents.Split", &document{Title: "b", Tags: []string{"x", "y"}})
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		var tags []string
+		for {
+			msg := &document{}
+			if err := stream.Recv(msg); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			tags = append(tags, msg.Tags...)
+		}
+		if !reflect.DeepEqual(tags, []string{"x", "y"}) {
+			t.Errorf("Split got %v, want [x y]", tags)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		err := client.CallContext(ctx, "Documents.Tag", &document{}, &document{}, UseCodec("proto"))
+		if err == nil {
+			t.Error("proto codec marshalled a non-proto message")
+		}
+	})
+
+	t.Run("not registered", func(t *testing.T) {
+		err := client.CallContext(ctx, "Documents.Tag", &document{}, &document{}, UseCodec("cbor"))
+		if status.CodeOf(err) != status.Internal {
+			t.Errorf("CallContext error = %v, want Internal", err)
+		}
+	})
+
+	t.Run("unknown to the handler", func(t *testing.T) {
+		// Write the request by hand: the caller refuses unregistered codecs.
+		id := client.getNextRequestID()
+		responseChan := make(chan *frame, 1)
+		client.mu.Lock()
+		client.pendingCalls[id] = responseChan
+		client.mu.Unlock()
+
+		if err := client.writeRequest(frameRequest, id, "Documents.Tag", "cbor", 0, time.Time{}, nil, []byte("{}")); err != nil {
+			t.Fatalf("writeRequest failed: %v", err)
+		}
+		select {
+		case f := <-responseChan:
+			if err := client.callError(f); status.CodeOf(err) != status.Unimplemented {
+				t.Errorf("Response error = %v, want Unimplemented", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No response to a request with an unknown codec")
+		}
+	})
+
+	t.Run("not negotiated", func(t *testing.T) {
+		remote := &preface{version: ProtocolVersion, features: supportedFeatures &^ FeatureCodecs, maxFrameSize: MaxMessageSize}
+		peer := newRawHandshakePeer(t, remote.marshal())
+		err := peer.CallContext(ctx, "Documents.Tag", &document{}, &document{}, UseCodec("json"))
+		if status.CodeOf(err) != status.Unimplemented {
+			t.Errorf("CallContext error = %v, want Unimplemented", err)
+		}
+	})
+}
+
+func TestRpcPeer_WriteBatching(t *testing.T) {
+	newPeers := func(t *testing.T, flushDelay time.Duration) (*RpcPeer, *countingConn) {
+		t.Helper()
+		client, server := newPipePeers(t, []RpcPeerOption{WithWriteBatching(0, flushDelay)}, []RpcPeerOption{WithWriteBatching(0, 0)})
+		server.RegisterService("Broken", &brokenService{})
+		return client, client.Stream.(*countingConn)
+	}
+
+	// callConcurrently makes n calls at once and fails the test unless all
+	// of them succeed.
+	callConcurrently := func(t *testing.T, client *RpcPeer, n int) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				want := fmt.Sprintf("call %d", i)
+				resp := &wrapperspb.StringValue{}
+				if err := client.CallContext(context.Background(), "Broken.Echo", wrapperspb.String(want), resp); err != nil {
+					errs <- err
+				} else if resp.Value != want {
+					errs <- fmt.Errorf("got %q, want %q", resp.Value, want)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("Call failed: %v", err)
+		}
+	}
+
+	t.Run("coalesces concurrent calls", func(t *testing.T) {
+		client, conn := newPeers(t, 20*time.Millisecond)
+
+		const calls = 50
+		callConcurrently(t, client, calls)
+		if writes := conn.writes.Load(); writes >= calls/2 {
+			t.Errorf("%d calls took %d writes", calls, writes)
+		}
+	})
+
+	t.Run("without delay", func(t *testing.T) {
+		client, _ := newPeers(t, 0)
+		callConcurrently(t, client, 50)
+	})
+
+	t.Run("closed peer", func(t *testing.T) {
+		client, _ := newPeers(t, 0)
+		client.Close()
+
+		err := client.CallContext(context.Background(), "Broken.Echo", wrapperspb.String("hi"), &wrapperspb.StringValue{})
+		if err == nil {
+			t.Error("Call on a closed peer succeeded")
+		}
+	})
+}
+
+// sizedService produces messages of the requested size.
+type sizedService struct{}
+
+func (s *sizedService) Make(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.BytesValue, error) {
+	return wrapperspb.Bytes(make([]byte, req.Value)), nil
+}
+
+func (s *sizedService) Grow(ctx context.Context, req *wrapperspb.Int32Value, stream ServerStream) error {
+	for n := int32(1); n <= req.Value; n *= 10 {
+		if err := stream.Send(wrapperspb.Bytes(make([]byte, n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sizedService) Echo(ctx context.Context, req *wrapperspb.BytesValue) (*wrapperspb.BytesValue, error) {
+	return req, nil
+}
+
+func TestRpcPeer_MessageSize(t *testing.T) {
+	ctx := context.Background()
+
+	// expectExhausted checks that err is ResourceExhausted and that the
+	// connection still serves calls.
+	expectExhausted := func(t *testing.T, client *RpcPeer, err error) {
+		t.Helper()
+		if status.CodeOf(err) != status.ResourceExhausted {
+			t.Errorf("Error = %v, want ResourceExhausted", err)
+		}
+		resp := &wrapperspb.BytesValue{}
+		if err := client.CallContext(ctx, "Sized.Make", wrapperspb.Int32(10), resp); err != nil {
+			t.Errorf("Call after the rejected message failed: %v", err)
+		} else if len(resp.Value) != 10 {
+			t.Errorf("Make returned %d bytes, want 10", len(resp.Value))
+		}
+	}
+
+	// Over the limits of 100 bytes below, but not so far that the
+	// connection is closed.
+	large := wrapperspb.Bytes(make([]byte, 300))
+
+	t.Run("send limit", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithMaxSendMsgSize(100)}, nil)
+		server.RegisterService("Sized", &sizedService{})
+		conn := client.Stream.(*countingConn)
+
+		err := client.CallContext(ctx, "Sized.Echo", large, &wrapperspb.BytesValue{})
+		if conn.written.Load() != 0 {
+			t.Error("Oversized request was written")
+		}
+		expectExhausted(t, client, err)
+	})
+
+	t.Run("handler receive limit", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxRecvMsgSize(100)})
+		server.RegisterService("Sized", &sizedService{})
+		expectExhausted(t, client, client.CallContext(ctx, "Sized.Echo", large, &wrapperspb.BytesValue{}))
+	})
+
+	t.Run("handler send limit", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxSendMsgSize(100)})
+		server.RegisterService("Sized", &sizedService{})
+		expectExhausted(t, client, client.CallContext(ctx, "Sized.Make", wrapperspb.Int32(1000), &wrapperspb.BytesValue{}))
+	})
+
+	t.Run("caller receive limit", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithMaxRecvMsgSize(100)}, nil)
+		server.RegisterService("Sized", &sizedService{})
+		expectExhausted(t, client, client.CallContext(ctx, "Sized.Make", wrapperspb.Int32(300), &wrapperspb.BytesValue{}))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithMaxRecvMsgSize(100)}, nil)
+		server.RegisterService("Sized", &sizedService{})
+
+		stream, err := client.CallStream(ctx, "Sized.Grow", wrapperspb.Int32(100))
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		received := 0
+		for err == nil {
+			if err = stream.Recv(&wrapperspb.BytesValue{}); err == nil {
+				received++
+			}
+		}
+		if received != 2 {
+			t.Errorf("Received %d messages before the oversized one, want 2", received)
+		}
+		expectExhausted(t, client, err)
+	})
+
+	t.Run("far beyond the limit", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxRecvMsgSize(100)})
+		server.RegisterService("Sized", &sizedService{})
+
+		err := client.CallContext(ctx, "Sized.Echo", wrapperspb.Bytes(make([]byte, 1000)), &wrapperspb.BytesValue{})
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("CallContext error = %v, want %v", err, ErrPeerClosed)
+		}
+		select {
+		case err := <-server.ErrorChannel():
+			if err == nil {
+				t.Error("Handler end reported no error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Handler end kept the connection open")
+		}
+	})
+
+	t.Run("announced in the handshake", func(t *testing.T) {
+		client, server := newPipePeers(t, []RpcPeerOption{WithHandshake()}, []RpcPeerOption{WithHandshake(), WithMaxRecvMsgSize(100)})
+		server.RegisterService("Sized", &sizedService{})
+		conn := client.Stream.(*countingConn)
+		if err := client.Handshake(ctx); err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+
+		written := conn.written.Load()
+		err := client.CallContext(ctx, "Sized.Echo", large, &wrapperspb.BytesValue{})
+		if conn.written.Load() != written {
+			t.Error("Request over the announced limit was written")
+		}
+		expectExhausted(t, client, err)
+	})
+
+	t.Run("raised without handshake", func(t *testing.T) {
+		limit := []RpcPeerOption{WithMaxSendMsgSize(2 * MaxMessageSize), WithMaxRecvMsgSize(2 * MaxMessageSize)}
+		client, server := newPipePeers(t, limit, limit)
+		server.RegisterService("Sized", &sizedService{})
+
+		huge := wrapperspb.Bytes(make([]byte, MaxMessageSize+1))
+		resp := &wrapperspb.BytesValue{}
+		if err := client.CallContext(ctx, "Sized.Echo", huge, resp); err != nil {
+			t.Fatalf("Call over the default limit failed: %v", err)
+		}
+		if len(resp.Value) != len(huge.Value) {
+			t.Errorf("Echo returned %d bytes, want %d", len(resp.Value), len(huge.Value))
+		}
+	})
+
+	t.Run("decompressed", func(t *testing.T) {
+		client, server := newPipePeers(t,
+			[]RpcPeerOption{WithHandshake(), WithCompressor("gzip")},
+			[]RpcPeerOption{WithHandshake(), WithMaxRecvMsgSize(2000)})
+		server.RegisterService("Sized", &sizedService{})
+
+		huge := wrapperspb.Bytes(make([]byte, 100000))
+		expectExhausted(t, client, client.CallContext(ctx, "Sized.Echo", huge, &wrapperspb.BytesValue{}))
+	})
+}
+
+// gateService holds every call until its gate is opened.
+type gateService struct {
+	gate chan struct{}
+}
+
+func newGateService() *gateService {
+	return &gateService{gate: make(chan struct{})}
+}
+
+func (s *gateService) Hold(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	select {
+	case <-s.gate:
+		return req, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRpcPeer_MaxConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+	// hold starts a call that waits for the gate and returns its result.
+	hold := func(client *RpcPeer, ctx context.Context) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		}()
+		return result
+	}
+
+	expectSuccess := func(t *testing.T, results ...chan error) {
+		t.Helper()
+		for _, result := range results {
+			select {
+			case err := <-result:
+				if err != nil {
+					t.Errorf("Held call failed: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Held call did not finish")
+			}
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxConcurrentRequests(2)})
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		first, second := hold(client, ctx), hold(client, ctx)
+		waitFor(t, "two requests in flight", func() bool { return server.RequestStats().InFlight == 2 })
+
+		err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.ResourceExhausted {
+			t.Errorf("Error = %v, want ResourceExhausted", err)
+		}
+		if stats := server.RequestStats(); stats.Rejected != 1 || stats.Queued != 0 {
+			t.Errorf("RequestStats = %+v, want 1 rejected and none queued", stats)
+		}
+
+		close(svc.gate)
+		expectSuccess(t, first, second)
+		waitFor(t, "no requests in flight", func() bool { return server.RequestStats().InFlight == 0 })
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxConcurrentRequests(1), WithOverloadPolicy(QueueRequests(1))})
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		first := hold(client, ctx)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+		second := hold(client, ctx)
+		waitFor(t, "a queued request", func() bool { return server.RequestStats().Queued == 1 })
+
+		err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.ResourceExhausted {
+			t.Errorf("Error = %v, want ResourceExhausted", err)
+		}
+
+		close(svc.gate)
+		expectSuccess(t, first, second)
+		if stats := server.RequestStats(); stats.Rejected != 1 {
+			t.Errorf("Rejected = %d, want 1", stats.Rejected)
+		}
+	})
+
+	t.Run("queued request cancelled", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxConcurrentRequests(1), WithOverloadPolicy(QueueRequests(1))})
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		first := hold(client, ctx)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+		callCtx, cancel := context.WithCancel(ctx)
+		second := hold(client, callCtx)
+		waitFor(t, "a queued request", func() bool { return server.RequestStats().Queued == 1 })
+
+		cancel()
+		if err := <-second; !errors.Is(err, context.Canceled) {
+			t.Errorf("Error = %v, want context.Canceled", err)
+		}
+		waitFor(t, "the queue to drain", func() bool { return server.RequestStats().Queued == 0 })
+
+		close(svc.gate)
+		expectSuccess(t, first)
+	})
+
+	t.Run("block reading", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithMaxConcurrentRequests(1), WithOverloadPolicy(BlockReading())})
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		first := hold(client, ctx)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+		second := hold(client, ctx)
+		waitFor(t, "a blocked request", func() bool { return server.RequestStats().Queued == 1 })
+
+		close(svc.gate)
+		expectSuccess(t, first, second)
+		if stats := server.RequestStats(); stats.Rejected != 0 {
+			t.Errorf("Rejected = %d, want 0", stats.Rejected)
+		}
+	})
+}
+
+func TestRpcPeer_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	hold := func(client *RpcPeer) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		}()
+		return result
+	}
+
+	t.Run("drains in-flight calls", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		held := hold(client)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(ctx) }()
+		waitFor(t, "the GOAWAY frame", func() bool {
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return client.goAwayReceived
+		})
+
+		err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Call after GOAWAY error = %v, want ErrPeerClosed", err)
+		}
+		select {
+		case err := <-shutdown:
+			t.Fatalf("Shutdown returned %v before the in-flight call finished", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(svc.gate)
+		if err := <-held; err != nil {
+			t.Errorf("In-flight call failed: %v", err)
+		}
+		select {
+		case err := <-shutdown:
+			if err != nil {
+				t.Errorf("Shutdown failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Shutdown did not return after the calls finished")
+		}
+	})
+
+	t.Run("flushes batched responses", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, []RpcPeerOption{WithWriteBatching(0, 50*time.Millisecond)})
+		svc := newGateService()
+		server.RegisterService("Gate", svc)
+
+		const calls = 20
+		held := make([]chan error, calls)
+		for i := range held {
+			held[i] = hold(client)
+		}
+		waitFor(t, "the requests in flight", func() bool { return server.RequestStats().InFlight == calls })
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- server.Shutdown(ctx) }()
+		close(svc.gate)
+
+		for _, result := range held {
+			select {
+			case err := <-result:
+				if err != nil {
+					t.Errorf("Drained call failed: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Drained call did not finish")
+			}
+		}
+		if err := <-shutdown; err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	})
+
+	t.Run("context expires", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Gate", newGateService())
+
+		held := hold(client)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown error = %v, want DeadlineExceeded", err)
+		}
+
+		client.Close()
+		if err := <-held; !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Held call error = %v, want ErrPeerClosed", err)
+		}
+	})
+
+	t.Run("close fails pending calls", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Gate", newGateService())
+
+		held := hold(client)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+
+		client.Close()
+		if err := <-held; !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Pending call error = %v, want ErrPeerClosed", err)
+		} else if status.CodeOf(err) != status.Unavailable {
+			t.Errorf("Pending call code = %v, want Unavailable", status.CodeOf(err))
+		}
+
+		err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Call after Close error = %v, want ErrPeerClosed", err)
+		}
+		if _, err := client.CallStream(ctx, "Gate.Hold", wrapperspb.Int32(1)); !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("CallStream after Close error = %v, want ErrPeerClosed", err)
+		}
+	})
+
+	t.Run("connection lost fails pending calls", func(t *testing.T) {
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Gate", newGateService())
+
+		held := hold(client)
+		waitFor(t, "a request in flight", func() bool { return server.RequestStats().InFlight == 1 })
+
+		server.Close()
+		select {
+		case err := <-held:
+			if !errors.Is(err, ErrPeerClosed) {
+				t.Errorf("Pending call error = %v, want ErrPeerClosed", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Pending call did not fail after the connection was lost")
+		}
+
+		err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Call after the connection was lost error = %v, want ErrPeerClosed", err)
+		}
+	})
+}
+
+// flakyListener fails its first failures Accept calls with a temporary
+// error, like a listener running out of file descriptors.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int64
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	newServer := func(t *testing.T, opts ...ServerOption) (*Server, *gateService, net.Listener, chan error) {
+		t.Helper()
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		srv := NewServer(opts...)
+		svc := &gateService{gate: make(chan struct{})}
+		srv.RegisterService("Gate", svc)
+
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(lis) }()
+		t.Cleanup(srv.Stop)
+		return srv, svc, lis, served
+	}
+	dial := func(t *testing.T, lis net.Listener) *RpcPeer {
+		t.Helper()
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		client := NewRpcPeer(conn)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	hold := func(client *RpcPeer) chan error {
+		result := make(chan error, 1)
+		go func() {
+			result <- client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		}()
+		return result
+	}
+
+	t.Run("serves every connection", func(t *testing.T) {
+		var connected, disconnected atomic.Int64
+		_, svc, lis, _ := newServer(t,
+			OnConnect(func(*RpcPeer) { connected.Add(1) }),
+			OnDisconnect(func(*RpcPeer, error) { disconnected.Add(1) }))
+		close(svc.gate)
+
+		first, second := dial(t, lis), dial(t, lis)
+		for _, client := range []*RpcPeer{first, second} {
+			resp := &wrapperspb.Int32Value{}
+			if err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(7), resp); err != nil {
+				t.Fatalf("Call failed: %v", err)
+			}
+			if resp.Value != 7 {
+				t.Errorf("Response = %d, want 7", resp.Value)
+			}
+		}
+		if n := connected.Load(); n != 2 {
+			t.Errorf("OnConnect called %d times, want 2", n)
+		}
+
+		first.Close()
+		waitFor(t, "OnDisconnect", func() bool { return disconnected.Load() == 1 })
+	})
+
+	t.Run("connection limit", func(t *testing.T) {
+		_, svc, lis, _ := newServer(t, WithMaxConnections(1))
+		close(svc.gate)
+
+		first := dial(t, lis)
+		if err := first.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{}); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+
+		second := dial(t, lis)
+		select {
+		case err := <-second.ErrorChannel():
+			if err == nil {
+				t.Error("Connection over the limit ended without an error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Connection over the limit was not closed")
+		}
+	})
+
+	t.Run("temporary accept errors", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		flaky := &flakyListener{Listener: lis}
+		flaky.failures.Store(3)
+		srv := NewServer()
+		svc := newGateService()
+		close(svc.gate)
+		srv.RegisterService("Gate", svc)
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(flaky) }()
+		t.Cleanup(srv.Stop)
+
+		client := dial(t, lis)
+		if err := client.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{}); err != nil {
+			t.Fatalf("Call after temporary accept errors failed: %v", err)
+		}
+		select {
+		case err := <-served:
+			t.Fatalf("Serve returned %v after a temporary error", err)
+		default:
+		}
+	})
+
+	t.Run("graceful stop", func(t *testing.T) {
+		srv, svc, lis, served := newServer(t)
+
+		client := dial(t, lis)
+		held := hold(client)
+		waitFor(t, "a request in flight", func() bool {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			for peer := range srv.peers {
+				if peer.RequestStats().InFlight == 1 {
+					return true
+				}
+			}
+			return false
+		})
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- srv.GracefulStop(ctx) }()
+		if err := <-served; err != ErrServerStopped {
+			t.Errorf("Serve returned %v, want ErrServerStopped", err)
+		}
+		if _, err := net.Dial("tcp", lis.Addr().String()); err == nil {
+			t.Error("Listener still accepts connections after GracefulStop")
+		}
+
+		close(svc.gate)
+		if err := <-held; err != nil {
+			t.Errorf("In-flight call failed: %v", err)
+		}
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("GracefulStop failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("GracefulStop did not return")
+		}
+	})
+}
+
+func TestBackoffConfig_Delay(t *testing.T) {
+	bc := BackoffConfig{BaseDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	for retries, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := bc.delay(retries); got != want {
+			t.Errorf("delay(%d) = %v, want %v", retries, got, want)
+		}
+	}
+
+	bc.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := bc.delay(1); d < time.Second || d > 3*time.Second {
+			t.Fatalf("delay(1) with jitter = %v, want within [1s, 3s]", d)
+		}
+	}
+}
+
+func TestClientConn(t *testing.T) {
+	ctx := context.Background()
+	fastBackoff := WithBackoff(BackoffConfig{BaseDelay: 10 * time.Millisecond, Multiplier: 1, MaxDelay: 10 * time.Millisecond})
+
+	// newServer serves an open gate and returns its address and the peers of
+	// the connections it accepted.
+	newServer := func(t *testing.T) (string, chan *RpcPeer) {
+		t.Helper()
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		connected := make(chan *RpcPeer, 10)
+		srv := NewServer(OnConnect(func(peer *RpcPeer) { connected <- peer }))
+		svc := &gateService{gate: make(chan struct{})}
+		close(svc.gate)
+		srv.RegisterService("Gate", svc)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		return lis.Addr().String(), connected
+	}
+	// listen serves svc and returns the server and its address.
+	listen := func(t *testing.T, svc *gateService) (*Server, string) {
+		t.Helper()
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		srv := NewServer()
+		srv.RegisterService("Gate", svc)
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		return srv, lis.Addr().String()
+	}
+	call := func(cc *ClientConn, opts ...CallOption) error {
+		return cc.CallContext(ctx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{}, opts...)
+	}
+
+	t.Run("reconnects", func(t *testing.T) {
+		addr, connected := newServer(t)
+		cc := NewClientConn(TCPDialer(addr), fastBackoff)
+		defer cc.Close()
+		cc.RegisterService("Gate", &gateService{gate: make(chan struct{})})
+
+		if state := cc.GetState(); state != Idle {
+			t.Errorf("Initial state = %v, want IDLE", state)
+		}
+		if err := call(cc); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		if state := cc.GetState(); state != Ready {
+			t.Errorf("State after a call = %v, want READY", state)
+		}
+
+		first := <-connected
+		first.Close()
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if !cc.WaitForStateChange(waitCtx, Ready) {
+			t.Fatal("State did not change after the connection dropped")
+		}
+
+		if err := call(cc, WaitForReady(true)); err != nil {
+			t.Fatalf("Call after reconnecting failed: %v", err)
+		}
+		second := <-connected
+		if second == first {
+			t.Error("Call did not use a new connection")
+		}
+
+		// Services registered on the ClientConn are served on every
+		// connection.
+		holdCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := second.CallContext(holdCtx, "Gate.Hold", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Call to the client's service error = %v, want DeadlineExceeded from the held gate", err)
+		}
+	})
+
+	t.Run("fail fast and wait for ready", func(t *testing.T) {
+		addr, _ := newServer(t)
+		var reachable atomic.Bool
+		dial := func(ctx context.Context) (Stream, error) {
+			if !reachable.Load() {
+				return nil, errors.New("unreachable")
+			}
+			return TCPDialer(addr)(ctx)
+		}
+		cc := NewClientConn(dial, fastBackoff)
+		defer cc.Close()
+
+		if err := call(cc); status.CodeOf(err) != status.Unavailable {
+			t.Errorf("Call error = %v, want Unavailable", err)
+		}
+		if state := cc.GetState(); state != TransientFailure && state != Connecting {
+			t.Errorf("State = %v, want TRANSIENT_FAILURE or CONNECTING", state)
+		}
+
+		waiting := make(chan error, 1)
+		go func() { waiting <- call(cc, WaitForReady(true)) }()
+		select {
+		case err := <-waiting:
+			t.Fatalf("WaitForReady call returned %v while unreachable", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		reachable.Store(true)
+		select {
+		case err := <-waiting:
+			if err != nil {
+				t.Errorf("WaitForReady call failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("WaitForReady call did not finish once reachable")
+		}
+	})
+
+	t.Run("moves on after GOAWAY", func(t *testing.T) {
+		held := newGateService()
+		stopping, stoppingAddr := listen(t, held)
+		open := newGateService()
+		close(open.gate)
+		_, nextAddr := listen(t, open)
+
+		var dials atomic.Int64
+		dial := func(ctx context.Context) (Stream, error) {
+			if dials.Add(1) == 1 {
+				return TCPDialer(stoppingAddr)(ctx)
+			}
+			return TCPDialer(nextAddr)(ctx)
+		}
+		cc := NewClientConn(dial, fastBackoff)
+		defer cc.Close()
+
+		inFlight := make(chan error, 1)
+		go func() { inFlight <- call(cc) }()
+		waitFor(t, "a request in flight", func() bool {
+			stopping.mu.Lock()
+			defer stopping.mu.Unlock()
+			for peer := range stopping.peers {
+				if peer.RequestStats().InFlight == 1 {
+					return true
+				}
+			}
+			return false
+		})
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- stopping.GracefulStop(ctx) }()
+		waitFor(t, "a new connection", func() bool { return dials.Load() == 2 && cc.GetState() == Ready })
+		if err := call(cc); err != nil {
+			t.Errorf("Call after GOAWAY failed: %v", err)
+		}
+
+		close(held.gate)
+		if err := <-inFlight; err != nil {
+			t.Errorf("Call in progress at GOAWAY failed: %v", err)
+		}
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("GracefulStop failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("GracefulStop did not return")
+		}
+	})
+
+	t.Run("GOAWAY right after connecting", func(t *testing.T) {
+		open := newGateService()
+		close(open.gate)
+		stopping, stoppingAddr := listen(t, open)
+		_, nextAddr := listen(t, open)
+
+		var dials atomic.Int64
+		dial := func(ctx context.Context) (Stream, error) {
+			if dials.Add(1) == 1 {
+				return TCPDialer(stoppingAddr)(ctx)
+			}
+			return TCPDialer(nextAddr)(ctx)
+		}
+		// Backing off would hold the next connection up for seconds.
+		cc := NewClientConn(dial, WithBackoff(BackoffConfig{BaseDelay: 5 * time.Second, Multiplier: 1, MaxDelay: 5 * time.Second}))
+		defer cc.Close()
+
+		cc.Connect()
+		waitFor(t, "the connection", func() bool { return cc.GetState() == Ready })
+		if err := stopping.GracefulStop(ctx); err != nil {
+			t.Fatalf("GracefulStop failed: %v", err)
+		}
+
+		// waitFor gives up long before the backoff would end.
+		waitFor(t, "a new connection", func() bool { return dials.Load() == 2 && cc.GetState() == Ready })
+		if err := call(cc); err != nil {
+			t.Errorf("Call after GOAWAY failed: %v", err)
+		}
+	})
+
+	t.Run("backs off after dropped connections", func(t *testing.T) {
+		var dials atomic.Int64
+		dial := func(ctx context.Context) (Stream, error) {
+			dials.Add(1)
+			c1, c2 := net.Pipe()
+			// Accepted and dropped at once, like a server over its
+			// connection limit.
+			c2.Close()
+			return c1, nil
+		}
+		cc := NewClientConn(dial, WithBackoff(BackoffConfig{BaseDelay: 50 * time.Millisecond, Multiplier: 1.6, MaxDelay: time.Second}))
+		defer cc.Close()
+
+		cc.Connect()
+		time.Sleep(300 * time.Millisecond)
+		if n := dials.Load(); n > 6 {
+			t.Errorf("Dialed %d times in 300ms with a 50ms base delay", n)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		addr, _ := newServer(t)
+		cc := NewClientConn(TCPDialer(addr))
+		cc.Connect()
+		waitFor(t, "the connection", func() bool { return cc.GetState() == Ready })
+
+		if err := cc.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if state := cc.GetState(); state != Shutdown {
+			t.Errorf("State after Close = %v, want SHUTDOWN", state)
+		}
+		if err := call(cc); !errors.Is(err, ErrClientConnClosed) {
+			t.Errorf("Call after Close error = %v, want ErrClientConnClosed", err)
+		}
+	})
+}
+
+// fakeBackend counts the calls made on it and fails them with err. Calls
+// wait for block to be closed, if set.
+type fakeBackend struct {
+	calls atomic.Int64
+	err   error
+	block chan struct{}
+}
+
+func (f *fakeBackend) Call(methodName string, request, response interface{}) error {
+	return f.CallContext(context.Background(), methodName, request, response)
+}
+
+func (f *fakeBackend) CallContext(ctx context.Context, methodName string, request, response interface{}, opts ...CallOption) error {
+	f.calls.Add(1)
+	if f.block != nil {
+		<-f.block
+	}
+	return f.err
+}
+
+func (f *fakeBackend) CallStream(ctx context.Context, methodName string, request interface{}, opts ...CallOption) (ClientStream, error) {
+	f.calls.Add(1)
+	return &fakeStream{ctx: ctx}, f.err
+}
+
+func (f *fakeBackend) OpenStream(ctx context.Context, methodName string, opts ...CallOption) (BidiStream, error) {
+	f.calls.Add(1)
+	return &fakeStream{ctx: ctx}, f.err
+}
+
+// fakeStream is a stream that ends right away.
+type fakeStream struct {
+	ctx context.Context
+}
+
+func (s *fakeStream) Context() context.Context   { return s.ctx }
+func (s *fakeStream) Send(msg interface{}) error { return nil }
+func (s *fakeStream) Recv(msg interface{}) error { return io.EOF }
+func (s *fakeStream) CloseSend() error           { return nil }
+
+func TestBalancer(t *testing.T) {
+	ctx := context.Background()
+	newBalancer := func(policy BalancerPolicy, n int, opts ...BalancerOption) (*Balancer, []*fakeBackend) {
+		b := NewBalancer(policy, opts...)
+		backends := make([]*fakeBackend, n)
+		for i := range backends {
+			backends[i] = &fakeBackend{}
+			b.Add(fmt.Sprintf("backend-%d", i), backends[i])
+		}
+		return b, backends
+	}
+	call := func(b *Balancer, opts ...CallOption) error {
+		return b.CallContext(ctx, "Service.Method", nil, nil, opts...)
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		b, backends := newBalancer(RoundRobin(), 3)
+		for i := 0; i < 6; i++ {
+			if err := call(b); err != nil {
+				t.Fatalf("Call failed: %v", err)
+			}
+		}
+		for i, be := range backends {
+			if n := be.calls.Load(); n != 2 {
+				t.Errorf("Backend %d got %d calls, want 2", i, n)
+			}
+		}
+	})
+
+	for _, policy := range []struct {
+		name   string
+		policy BalancerPolicy
+	}{
+		{"least in flight", LeastInFlight()},
+		{"power of two choices", PowerOfTwoChoices()},
+	} {
+		t.Run(policy.name, func(t *testing.T) {
+			b, backends := newBalancer(policy.policy, 2)
+			backends[0].block = make(chan struct{})
+			backends[1].block = make(chan struct{})
+
+			// Whichever backend gets the first call is busy until released.
+			done := make(chan error, 1)
+			go func() { done <- call(b) }()
+			waitFor(t, "a call in flight", func() bool { return backends[0].calls.Load()+backends[1].calls.Load() == 1 })
+			busy, idle := backends[0], backends[1]
+			if busy.calls.Load() == 0 {
+				busy, idle = idle, busy
+			}
+
+			close(idle.block)
+			for i := 0; i < 10; i++ {
+				if err := call(b); err != nil {
+					t.Fatalf("Call failed: %v", err)
+				}
+			}
+			if n := busy.calls.Load(); n != 1 {
+				t.Errorf("Busy backend got %d calls, want only the first", n)
+			}
+
+			close(busy.block)
+			if err := <-done; err != nil {
+				t.Errorf("First call failed: %v", err)
+			}
+			for _, be := range b.Backends() {
+				if be.InFlight() != 0 {
+					t.Errorf("Backend %s has %d calls in flight, want 0", be.Name(), be.InFlight())
+				}
+			}
+		})
+	}
+
+	t.Run("consistent hash", func(t *testing.T) {
+		b, _ := newBalancer(ConsistentHash(), 5)
+		owners := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			owner := ConsistentHash().Pick(key, b.Backends()).Name()
+			if again := ConsistentHash().Pick(key, b.Backends()).Name(); again != owner {
+				t.Fatalf("Key %s mapped to %s and then %s", key, owner, again)
+			}
+			owners[key] = owner
+		}
+
+		// Removing a backend only moves its own keys.
+		b.Remove("backend-2")
+		for key, owner := range owners {
+			if got := ConsistentHash().Pick(key, b.Backends()).Name(); owner != "backend-2" && got != owner {
+				t.Errorf("Key %s moved from %s to %s", key, owner, got)
+			}
+		}
+
+		if err := call(b, BalanceKey("key-1")); err != nil {
+			t.Errorf("Call with a balance key failed: %v", err)
+		}
+	})
+
+	t.Run("ejection", func(t *testing.T) {
+		b, backends := newBalancer(RoundRobin(), 2, WithEjectionTime(50*time.Millisecond))
+		backends[0].err = ErrPeerClosed
+
+		if err := call(b); !errors.Is(err, ErrPeerClosed) {
+			t.Fatalf("Call error = %v, want ErrPeerClosed", err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := call(b); err != nil {
+				t.Errorf("Call after ejection failed: %v", err)
+			}
+		}
+		if n := backends[0].calls.Load(); n != 1 {
+			t.Errorf("Ejected backend got %d calls, want 1", n)
+		}
+
+		// Application errors and cancelled calls do not eject.
+		backends[0].err = status.Errorf(status.NotFound, "missing")
+		time.Sleep(60 * time.Millisecond)
+		for i := 0; i < 4; i++ {
+			call(b)
+		}
+		if n := backends[0].calls.Load(); n != 3 {
+			t.Errorf("Backend back in rotation got %d calls, want 3", n)
+		}
+
+		// With every backend ejected, calls still go out.
+		backends[0].err, backends[1].err = ErrPeerClosed, ErrPeerClosed
+		call(b)
+		call(b)
+		if err := call(b); !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("Call with every backend ejected error = %v, want ErrPeerClosed", err)
+		}
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		b, backends := newBalancer(RoundRobin(), 1)
+		stream, err := b.CallStream(ctx, "Service.Stream", nil)
+		if err != nil {
+			t.Fatalf("CallStream failed: %v", err)
+		}
+		be := b.Backends()[0]
+		if be.InFlight() != 1 {
+			t.Errorf("InFlight = %d during the stream, want 1", be.InFlight())
+		}
+		if err := stream.Recv(nil); err != io.EOF {
+			t.Errorf("Recv error = %v, want io.EOF", err)
+		}
+		if be.InFlight() != 0 || !be.Healthy() {
+			t.Errorf("After the stream ended InFlight = %d and Healthy = %v, want 0 and true", be.InFlight(), be.Healthy())
+		}
+		if n := backends[0].calls.Load(); n != 1 {
+			t.Errorf("Backend got %d calls, want 1", n)
+		}
+	})
+
+	t.Run("client stream ends with its response", func(t *testing.T) {
+		b := NewBalancer(LeastInFlight())
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Bidi", &bidiService{})
+		b.Add("replica", client)
+
+		// Like the generated CloseAndRecv: one Recv, which never sees
+		// io.EOF.
+		stream, err := b.OpenStream(ctx, "Bidi.Sum")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		for i := int32(1); i <= 3; i++ {
+			if err := stream.Send(wrapperspb.Int32(i)); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatalf("CloseSend failed: %v", err)
+		}
+		resp := &wrapperspb.Int32Value{}
+		if err := stream.Recv(resp); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if resp.Value != 6 {
+			t.Errorf("Sum = %d, want 6", resp.Value)
+		}
+		be := b.Backends()[0]
+		waitFor(t, "the call to end", func() bool { return be.InFlight() == 0 })
+	})
+
+	t.Run("peers as backends", func(t *testing.T) {
+		b := NewBalancer(RoundRobin())
+		for i := 0; i < 2; i++ {
+			client, server := newPipePeers(t, nil, nil)
+			server.RegisterService("Documents", &documentService{})
+			b.Add(fmt.Sprintf("replica-%d", i), client)
+		}
+
+		for i := 0; i < 4; i++ {
+			resp := &document{}
+			if err := b.CallContext(ctx, "Documents.Tag", &document{Title: "doc"}, resp, UseCodec("json")); err != nil {
+				t.Fatalf("Call through the balancer failed: %v", err)
+			}
+		}
+	})
+
+	t.Run("handler returns Unavailable", func(t *testing.T) {
+		b := NewBalancer(RoundRobin())
+		client, server := newPipePeers(t, nil, nil)
+		server.RegisterService("Overloaded", &overloadedService{})
+		b.Add("replica", client)
+
+		err := b.CallContext(ctx, "Overloaded.Work", wrapperspb.Int32(1), &wrapperspb.Int32Value{})
+		if status.CodeOf(err) != status.Unavailable {
+			t.Fatalf("Call error = %v, want Unavailable", err)
+		}
+		if be := b.Backends()[0]; !be.Healthy() {
+			t.Error("Backend ejected for an error returned by its handler")
+		}
+	})
+
+	t.Run("client conn failing to connect", func(t *testing.T) {
+		b := NewBalancer(RoundRobin())
+		cc := NewClientConn(func(ctx context.Context) (Stream, error) { return nil, errors.New("unreachable") })
+		defer cc.Close()
+		b.Add("unreachable", cc)
+
+		cc.Connect()
+		waitFor(t, "the failed connection", func() bool { return cc.GetState() == TransientFailure })
+		if err := call(b); status.CodeOf(err) != status.Unavailable {
+			t.Fatalf("Call error = %v, want Unavailable", err)
+		}
+		if be := b.Backends()[0]; be.Healthy() {
+			t.Error("Backend that cannot connect not ejected")
+		}
+	})
+}
+
+// overloadedService fails every call with status.Unavailable, like a server
+// shedding load.
+type overloadedService struct{}
+
+func (s *overloadedService) Work(ctx context.Context, req *wrapperspb.Int32Value) (*wrapperspb.Int32Value, error) {
+	return nil, status.Errorf(status.Unavailable, "overloaded")
+}
+
 // Add more tests for error handling, message formatting, etc.
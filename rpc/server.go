@@ -0,0 +1,286 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	libp2pstream "github.com/jibuji/go-stream-rpc/stream/libp2p"
+	"github.com/jibuji/go-stream-rpc/stream/tcp"
+)
+
+// ErrServerStopped is returned by the Serve methods of a Server after Stop or
+// GracefulStop was called.
+var ErrServerStopped = errors.New("rpc: server stopped")
+
+// errTooManyConnections is returned by ServeStream for connections beyond the
+// limit set with WithMaxConnections.
+var errTooManyConnections = errors.New("rpc: too many connections")
+
+// Server accepts connections and serves the services registered with it on
+// each of them. Every connection gets its own RpcPeer, so handlers can call
+// back into the remote end through the peer passed to the OnConnect hook.
+type Server struct {
+	services     map[string]*service
+	peerOpts     []RpcPeerOption
+	onConnect    func(*RpcPeer)
+	onDisconnect func(*RpcPeer, error)
+	maxConns     int
+
+	mu        sync.Mutex
+	stopped   bool
+	done      chan struct{} // closed by Stop and GracefulStop
+	listeners map[net.Listener]struct{}
+	peers     map[*RpcPeer]struct{}
+	conns     sync.WaitGroup // connections being served
+}
+
+type ServerOption func(*Server)
+
+// WithPeerOptions sets the options of the RpcPeer created for each
+// connection.
+func WithPeerOptions(opts ...RpcPeerOption) ServerOption {
+	return func(s *Server) {
+		s.peerOpts = append(s.peerOpts, opts...)
+	}
+}
+
+// OnConnect sets a hook called with the peer of every new connection, after
+// the services have been registered on it and before it is served. The hook
+// runs on the connection's goroutine; the connection is served meanwhile.
+func OnConnect(f func(peer *RpcPeer)) ServerOption {
+	return func(s *Server) {
+		s.onConnect = f
+	}
+}
+
+// OnDisconnect sets a hook called once a connection has ended, with its peer
+// and the error that ended it, nil if the peer was closed.
+func OnDisconnect(f func(peer *RpcPeer, err error)) ServerOption {
+	return func(s *Server) {
+		s.onDisconnect = f
+	}
+}
+
+// WithMaxConnections limits the number of connections served at once.
+// Connections beyond the limit are closed right away. A non-positive n
+// removes the limit, which is the default.
+func WithMaxConnections(n int) ServerOption {
+	return func(s *Server) {
+		s.maxConns = n
+	}
+}
+
+// NewServer creates a server without any services.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		services:  make(map[string]*service),
+		done:      make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		peers:     make(map[*RpcPeer]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// RegisterService registers svc under name on every connection, like
+// RpcPeer.RegisterService. Services must be registered before the server
+// starts serving.
+func (s *Server) RegisterService(name string, svc interface{}) {
+	s.services[name] = &service{impl: svc}
+}
+
+// RegisterServiceDesc registers impl on every connection, like
+// RpcPeer.RegisterServiceDesc. Services must be registered before the server
+// starts serving.
+func (s *Server) RegisterServiceDesc(desc *ServiceDesc, impl interface{}) {
+	s.services[desc.ServiceName] = describedService(desc, impl)
+}
+
+// withServices registers services on a peer before it starts reading, so no
+// request can arrive before its service.
+func withServices(services map[string]*service) RpcPeerOption {
+	return func(p *RpcPeer) {
+		for name, svc := range services {
+			p.services[name] = svc
+		}
+	}
+}
+
+// Serve accepts connections on lis and serves each of them in its own
+// goroutine. It returns ErrServerStopped once the server is stopped, or the
+// error with which accepting failed. Temporary accept errors, such as running
+// out of file descriptors, are retried after a short delay instead. The
+// listener is closed when Serve returns.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerStopped
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, lis)
+		s.mu.Unlock()
+		lis.Close()
+	}()
+
+	var retryDelay time.Duration
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerStopped
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Running out of file descriptors and the like passes;
+				// wait for it rather than stop serving.
+				retryDelay = nextAcceptDelay(retryDelay)
+				timer := time.NewTimer(retryDelay)
+				select {
+				case <-timer.C:
+					continue
+				case <-s.done:
+					timer.Stop()
+					return ErrServerStopped
+				}
+			}
+			return err
+		}
+		retryDelay = 0
+		go s.ServeStream(tcp.NewTCPStream(conn))
+	}
+}
+
+// nextAcceptDelay returns how long Serve waits after a temporary accept
+// error that followed a wait of delay: 5ms at first, doubling up to a second.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		delay = time.Second
+	}
+	return delay
+}
+
+// ServeLibp2p serves the streams opened to h with protocolID, each in its own
+// goroutine. It blocks until the server is stopped, then removes the stream
+// handler and returns ErrServerStopped.
+func (s *Server) ServeLibp2p(h host.Host, protocolID protocol.ID) error {
+	h.SetStreamHandler(protocolID, func(st network.Stream) {
+		s.ServeStream(libp2pstream.NewLibP2PStream(st))
+	})
+	<-s.done
+	h.RemoveStreamHandler(protocolID)
+	return ErrServerStopped
+}
+
+// ServeStream serves a single connection, blocking until it ends. It is used
+// by Serve and ServeLibp2p and can serve connections accepted by other means,
+// such as WebSocket upgrades. It returns the error that ended the
+// connection, nil if its peer was closed.
+func (s *Server) ServeStream(stream Stream) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		stream.Close()
+		return ErrServerStopped
+	}
+	if s.maxConns > 0 && len(s.peers) >= s.maxConns {
+		s.mu.Unlock()
+		stream.Close()
+		return errTooManyConnections
+	}
+	opts := append(s.peerOpts[:len(s.peerOpts):len(s.peerOpts)], withServices(s.services))
+	peer := NewRpcPeer(stream, opts...)
+	s.peers[peer] = struct{}{}
+	s.conns.Add(1)
+	s.mu.Unlock()
+
+	defer s.conns.Done()
+
+	if s.onConnect != nil {
+		s.onConnect(peer)
+	}
+	err := peer.Wait()
+	peer.Close()
+
+	s.mu.Lock()
+	delete(s.peers, peer)
+	s.mu.Unlock()
+
+	if s.onDisconnect != nil {
+		s.onDisconnect(peer, err)
+	}
+	return err
+}
+
+// Stop stops accepting connections and closes every connection at once,
+// failing the calls in progress. It returns once all connections have been
+// closed.
+func (s *Server) Stop() {
+	for _, peer := range s.stop() {
+		peer.Close()
+	}
+	s.conns.Wait()
+}
+
+// GracefulStop stops accepting connections and shuts every connection down
+// with RpcPeer.Shutdown, letting the calls in progress finish. If ctx expires
+// first, the remaining connections are closed and the context's error is
+// returned. It returns once all connections have been closed.
+func (s *Server) GracefulStop(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var timedOut atomic.Bool
+	for _, peer := range s.stop() {
+		wg.Add(1)
+		go func(peer *RpcPeer) {
+			defer wg.Done()
+			if err := peer.Shutdown(ctx); err != nil && err == ctx.Err() {
+				timedOut.Store(true)
+			}
+		}(peer)
+	}
+	wg.Wait()
+	s.conns.Wait()
+	if timedOut.Load() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// stop marks the server stopped, closes its listeners and returns the peers
+// of the connections being served.
+func (s *Server) stop() []*RpcPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+	}
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	peers := make([]*RpcPeer, 0, len(s.peers))
+	for peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// ServiceDesc describes a service and the handlers of its methods. It is
+// emitted by protoc-gen-stream-rpc and passed to RegisterServiceDesc.
+type ServiceDesc struct {
+	// ServiceName is the name callers use, the part of "Service.Method"
+	// before the dot.
+	ServiceName string
+	// HandlerType is a pointer to the interface implementations must
+	// satisfy.
+	HandlerType interface{}
+	// Methods maps method names to their handlers.
+	Methods map[string]MethodDesc
+}
+
+// MethodDesc describes a method of a service.
+type MethodDesc struct {
+	// ClientStreams is set if the caller sends a stream of messages.
+	ClientStreams bool
+	// ServerStreams is set if the handler sends a stream of messages.
+	ServerStreams bool
+	// Handler handles calls of unary methods.
+	Handler UnaryMethodHandler
+	// StreamHandler handles calls of streaming methods.
+	StreamHandler StreamHandler
+}
+
+// UnaryMethodHandler handles a unary call on srv. It decodes the request with
+// dec, using the codec the caller chose, and, if interceptor is not nil, runs
+// the method through it.
+type UnaryMethodHandler func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error)
+
+// ServiceRegistrar is implemented by RpcPeer and Server, which both accept
+// service registrations. Generated Register functions take a
+// ServiceRegistrar.
+type ServiceRegistrar interface {
+	RegisterServiceDesc(desc *ServiceDesc, impl interface{})
+}
+
+// service is a registered service. Services registered with RegisterService
+// have no descriptor; their methods are found by reflection.
+type service struct {
+	impl interface{}
+	desc *ServiceDesc
+}
+
+// RegisterService registers service under name. Calls of "name.Method" are
+// dispatched by reflection to the exported method Method of service, which
+// must have one of the signatures described for unary and streaming calls.
+// Generated code registers services with RegisterServiceDesc instead.
+func (p *RpcPeer) RegisterService(name string, svc interface{}) {
+	p.services[name] = &service{impl: svc}
+}
+
+// RegisterServiceDesc registers impl as the implementation of the service
+// described by desc. Only the methods listed in desc can be called. It
+// panics if impl does not implement desc.HandlerType.
+func (p *RpcPeer) RegisterServiceDesc(desc *ServiceDesc, impl interface{}) {
+	p.services[desc.ServiceName] = describedService(desc, impl)
+}
+
+// describedService returns the service registered by RegisterServiceDesc,
+// panicking if impl does not implement desc.HandlerType.
+func describedService(desc *ServiceDesc, impl interface{}) *service {
+	if desc.HandlerType != nil {
+		ht := reflect.TypeOf(desc.HandlerType).Elem()
+		if !reflect.TypeOf(impl).Implements(ht) {
+			panic(fmt.Sprintf("rpc: RegisterServiceDesc found the handler of type %T that does not satisfy %v", impl, ht))
+		}
+	}
+	return &service{impl: impl, desc: desc}
+}
+
+// method returns the descriptor of the method called fullMethod.
+func (s *service) method(fullMethod, name string) (*MethodDesc, error) {
+	if s.desc == nil {
+		return reflectMethodDesc(s.impl, fullMethod, name)
+	}
+
+	md, ok := s.desc.Methods[name]
+	if !ok {
+		return nil, status.Errorf(status.Unimplemented, "method %s not found", name)
+	}
+	return &md, nil
+}
+
+func (md *MethodDesc) kind() methodKind {
+	switch {
+	case md.ClientStreams:
+		return bidiStreamingMethod
+	case md.ServerStreams:
+		return serverStreamingMethod
+	default:
+		return unaryMethod
+	}
+}
+
+// reflectMethodDesc describes the method name of a service registered with
+// RegisterService by looking it up with reflection.
+func reflectMethodDesc(impl interface{}, fullMethod, name string) (*MethodDesc, error) {
+	method := reflect.ValueOf(impl).MethodByName(name)
+	if !method.IsValid() {
+		return nil, status.Errorf(status.Unimplemented, "method %s not found", name)
+	}
+
+	kind, ok := methodKindOf(method.Type())
+	if !ok {
+		return nil, status.Errorf(status.InvalidArgument, "invalid method signature")
+	}
+
+	switch kind {
+	case unaryMethod:
+		return &MethodDesc{Handler: reflectUnaryHandler(method, fullMethod)}, nil
+	case serverStreamingMethod:
+		return &MethodDesc{ServerStreams: true, StreamHandler: reflectStreamHandler(method, kind)}, nil
+	default:
+		return &MethodDesc{ClientStreams: true, ServerStreams: true, StreamHandler: reflectStreamHandler(method, kind)}, nil
+	}
+}
+
+// reflectUnaryHandler returns a handler calling the unary method.
+func reflectUnaryHandler(method reflect.Value, fullMethod string) UnaryMethodHandler {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor UnaryServerInterceptor) (interface{}, error) {
+		req := reflect.New(method.Type().In(1).Elem()).Interface()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			// Call the method with the request context, which carries the
+			// session
+			results := method.Call([]reflect.Value{
+				reflect.ValueOf(ctx),
+				reflect.ValueOf(req),
+			})
+
+			// Handlers return either the response alone or the response
+			// and an error.
+			var err error
+			switch len(results) {
+			case 2:
+				err, _ = results[1].Interface().(error)
+			case 1:
+			default:
+				return nil, status.Errorf(status.Internal, "invalid method return values")
+			}
+
+			response := results[0].Interface()
+			if isNilMessage(response) {
+				response = nil
+			}
+			return response, err
+		}
+
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, &UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+	}
+}
+
+// reflectStreamHandler returns a handler calling the streaming method.
+func reflectStreamHandler(method reflect.Value, kind methodKind) StreamHandler {
+	return func(srv interface{}, stream BidiStream) error {
+		var results []reflect.Value
+		if kind == serverStreamingMethod {
+			request := reflect.New(method.Type().In(1).Elem()).Interface()
+			if err := stream.Recv(request); err != nil {
+				return status.Errorf(status.Internal, "failed to unmarshal request: %v", err)
+			}
+			results = method.Call([]reflect.Value{
+				reflect.ValueOf(stream.Context()),
+				reflect.ValueOf(request),
+				reflect.ValueOf(stream),
+			})
+		} else {
+			results = method.Call([]reflect.Value{
+				reflect.ValueOf(stream.Context()),
+				reflect.ValueOf(stream),
+			})
+		}
+
+		if len(results) != 1 {
+			return status.Errorf(status.Internal, "invalid method return values")
+		}
+		err, _ := results[0].Interface().(error)
+		return err
+	}
+}
+
+// isNilMessage reports whether a handler returned no message: nil, or a nil
+// pointer.
+func isNilMessage(msg interface{}) bool {
+	if msg == nil {
+		return true
+	}
+	v := reflect.ValueOf(msg)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// ErrPeerClosed is returned by calls that fail because the peer was closed
+// or shut down, because the connection was lost, or because the remote end
+// is shutting down and will not handle them. It carries status.Unavailable.
+// Calls refused before anything was sent, and calls the remote end rejected
+// with a GOAWAY frame, were not handled and can be retried on another
+// connection; calls in flight when the connection was lost or Close ran may
+// have been handled already.
+var ErrPeerClosed = status.Errorf(status.Unavailable, "rpc: peer closed")
+
+// Shutdown closes the peer gracefully. It tells the remote end with a GOAWAY
+// frame that no further requests will be handled, refuses new requests and
+// calls, and waits for the requests being handled and the calls this peer
+// made to finish, and for their responses to be written, before closing the
+// peer.
+//
+// If ctx expires first, Shutdown closes the peer anyway, failing the calls
+// still running, and returns the context's error. Otherwise it returns the
+// result of Close.
+func (p *RpcPeer) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	alreadyDraining := p.draining
+	p.draining = true
+	lastID := p.lastRemoteID
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+		p.checkDrained()
+	}
+	drained := p.drained
+	p.mu.Unlock()
+
+	if !alreadyDraining {
+		select {
+		case <-p.handshakeDone:
+			if p.handshakeErr == nil {
+				// Best effort: if the write fails the connection is gone
+				// and there is nothing left to drain.
+				p.writeFrame(lastID, frameGoAway, 0)
+			}
+		case <-ctx.Done():
+		}
+	}
+
+	select {
+	case <-drained:
+	case <-p.ctx.Done():
+		// Closed, or the connection dropped, while draining.
+		return p.Close()
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+	}
+
+	// The responses of the last calls may still wait in the write queue.
+	if err := p.flushWrites(ctx); err != nil && ctx.Err() != nil {
+		p.Close()
+		return ctx.Err()
+	}
+	return p.Close()
+}
+
+// checkDrained closes the channel Shutdown waits on once no requests are
+// being handled and no calls made by this peer are waiting for their
+// response. It must be called with p.mu held whenever a call is removed.
+func (p *RpcPeer) checkDrained() {
+	if p.drained == nil || len(p.inflight) > 0 || len(p.pendingCalls) > 0 || len(p.streams) > 0 {
+		return
+	}
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// callsRefused returns ErrPeerClosed once the peer no longer starts calls:
+// after Close or Shutdown, once the remote end sent a GOAWAY frame or once
+// the connection is gone. It must be called with p.mu held.
+func (p *RpcPeer) callsRefused() error {
+	if p.closed || p.draining || p.goAwayReceived || p.ctx.Err() != nil {
+		return ErrPeerClosed
+	}
+	return nil
+}
+
+// acceptRequest records a request about to be handled, with the function
+// cancelling its context, and reports whether the peer still accepts
+// requests. Doing both under one lock keeps Shutdown from seeing the request
+// neither refused nor in flight. It is called by the read loop.
+func (p *RpcPeer) acceptRequest(id uint32, cancel context.CancelFunc) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.draining {
+		return false
+	}
+	if id > p.lastRemoteID {
+		p.lastRemoteID = id
+	}
+	p.inflight[id] = cancel
+	return true
+}
+
+// handleGoAway stops new calls after the remote end announced its shutdown
+// and fails the calls it will not handle, those with an ID above lastID.
+func (p *RpcPeer) handleGoAway(lastID uint32) {
+	p.mu.Lock()
+	if !p.goAwayReceived {
+		p.goAwayReceived = true
+		close(p.goAway)
+	}
+	p.mu.Unlock()
+
+	p.failCalls(ErrPeerClosed, func(id uint32) bool { return id > lastID })
+}
+
+// goingAway reports whether the remote end sent a GOAWAY frame.
+func (p *RpcPeer) goingAway() bool {
+	select {
+	case <-p.goAway:
+		return true
+	default:
+		return false
+	}
+}
+
+// allCalls matches every call for failCalls.
+func allCalls(uint32) bool { return true }
+
+// failCalls fails the calls made by this peer for which match returns true,
+// unary and streaming, with err.
+func (p *RpcPeer) failCalls(err error, match func(id uint32) bool) {
+	p.mu.Lock()
+	var streams []*rpcStream
+	for id, ch := range p.pendingCalls {
+		if match(id) {
+			// The read loop removes a call before delivering its response,
+			// so nothing else sends on ch.
+			delete(p.pendingCalls, id)
+			ch <- &frame{id: id, recvErr: err}
+		}
+	}
+	for id, stream := range p.streams {
+		if match(id) {
+			delete(p.streams, id)
+			streams = append(streams, stream)
+		}
+	}
+	p.checkDrained()
+	p.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.finish(err)
+		stream.cancel()
+	}
+}
@@ -0,0 +1,75 @@
+package status
+
+import "strconv"
+
+// Code is the canonical outcome of a call. The numbering matches gRPC, so
+// codes can be mapped one to one when bridging the two.
+type Code uint32
+
+const (
+	// OK means the call succeeded.
+	OK Code = 0
+	// Canceled means the call was cancelled, typically by the caller.
+	Canceled Code = 1
+	// Unknown is used for errors that carry no more specific code.
+	Unknown Code = 2
+	// InvalidArgument means the request was invalid regardless of the
+	// state of the system.
+	InvalidArgument Code = 3
+	// DeadlineExceeded means the deadline passed before the call finished.
+	DeadlineExceeded Code = 4
+	// NotFound means a requested entity was not found.
+	NotFound Code = 5
+	// AlreadyExists means an entity the call tried to create already exists.
+	AlreadyExists Code = 6
+	// PermissionDenied means the caller may not perform the call.
+	PermissionDenied Code = 7
+	// ResourceExhausted means a quota or limit was reached.
+	ResourceExhausted Code = 8
+	// FailedPrecondition means the system is not in a state that allows
+	// the call.
+	FailedPrecondition Code = 9
+	// Aborted means the call was aborted, typically because of a
+	// concurrency conflict.
+	Aborted Code = 10
+	// OutOfRange means the request asked for something past a valid range.
+	OutOfRange Code = 11
+	// Unimplemented means the method does not exist or is not implemented.
+	Unimplemented Code = 12
+	// Internal means an invariant of the system was broken.
+	Internal Code = 13
+	// Unavailable means the service is currently unavailable; retrying may
+	// help.
+	Unavailable Code = 14
+	// DataLoss means data was lost or corrupted.
+	DataLoss Code = 15
+	// Unauthenticated means the caller could not be authenticated.
+	Unauthenticated Code = 16
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
@@ -0,0 +1,155 @@
+// Package status describes the outcome of RPC calls with a canonical code, a
+// message and optional structured details.
+//
+// Handlers fail a call by returning an error created by this package; the
+// code, message and details travel in the error frame and reach the caller as
+// an *Error, which can be inspected with errors.As or FromError.
+package status
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Status is the outcome of a call. A nil *Status is equivalent to OK.
+type Status struct {
+	code    Code
+	message string
+	details []*anypb.Any
+}
+
+// New returns a Status with the given code and message.
+func New(c Code, msg string) *Status {
+	return &Status{code: c, message: msg}
+}
+
+// Newf returns a Status with the given code and a formatted message.
+func Newf(c Code, format string, a ...any) *Status {
+	return New(c, fmt.Sprintf(format, a...))
+}
+
+// Errorf returns an error with the given code and a formatted message, or
+// nil for OK.
+func Errorf(c Code, format string, a ...any) error {
+	return Newf(c, format, a...).Err()
+}
+
+// Code returns the status code.
+func (s *Status) Code() Code {
+	if s == nil {
+		return OK
+	}
+	return s.code
+}
+
+// Message returns the status message.
+func (s *Status) Message() string {
+	if s == nil {
+		return ""
+	}
+	return s.message
+}
+
+// WithDetails returns a copy of s with the given messages appended as
+// details. It fails for OK statuses, which cannot carry details.
+func (s *Status) WithDetails(details ...proto.Message) (*Status, error) {
+	if s.Code() == OK {
+		return nil, errors.New("status: no details allowed on OK status")
+	}
+
+	c := &Status{code: s.code, message: s.message, details: append([]*anypb.Any(nil), s.details...)}
+	for _, detail := range details {
+		a, err := anypb.New(detail)
+		if err != nil {
+			return nil, err
+		}
+		c.details = append(c.details, a)
+	}
+	return c, nil
+}
+
+// Details returns the details of s, each unpacked into its message type. A
+// detail whose type is not linked into the binary is returned as the error
+// encountered while unpacking it.
+func (s *Status) Details() []any {
+	if s == nil {
+		return nil
+	}
+
+	details := make([]any, 0, len(s.details))
+	for _, a := range s.details {
+		msg, err := a.UnmarshalNew()
+		if err != nil {
+			details = append(details, err)
+			continue
+		}
+		details = append(details, msg)
+	}
+	return details
+}
+
+// Err returns the status as an *Error, or nil for OK.
+func (s *Status) Err() error {
+	if s.Code() == OK {
+		return nil
+	}
+	return &Error{Code: s.code, Message: s.message, Details: s.details}
+}
+
+// Error is the error form of a non-OK Status. It is what callers receive when
+// a call fails.
+type Error struct {
+	Code    Code
+	Message string
+	// Details carries structured information about the error, as
+	// messages packed into anypb.Any.
+	Details []*anypb.Any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.Code, e.Message)
+}
+
+// Status returns the status e represents.
+func (e *Error) Status() *Status {
+	return &Status{code: e.Code, message: e.Message, details: e.Details}
+}
+
+// Is reports whether target is an *Error with the same code and message, so
+// that errors.Is can match errors created with the same arguments.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e.Code == t.Code && e.Message == t.Message
+}
+
+// FromError returns the status carried by err. It reports ok for nil, which
+// yields a nil (OK) status, and for errors wrapping an *Error. Any other error
+// yields an Unknown status with the error text as message.
+func FromError(err error) (s *Status, ok bool) {
+	if err == nil {
+		return nil, true
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status(), true
+	}
+	return New(Unknown, err.Error()), false
+}
+
+// Convert is like FromError but drops the ok result.
+func Convert(err error) *Status {
+	s, _ := FromError(err)
+	return s
+}
+
+// CodeOf returns the code of the status carried by err: OK for nil, and
+// Unknown for errors that carry no status.
+func CodeOf(err error) Code {
+	return Convert(err).Code()
+}
@@ -0,0 +1,91 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodeString(t *testing.T) {
+	tests := map[Code]string{
+		OK:              "OK",
+		NotFound:        "NotFound",
+		Unauthenticated: "Unauthenticated",
+		Code(42):        "Code(42)",
+	}
+	for code, want := range tests {
+		if got := code.String(); got != want {
+			t.Errorf("Code(%d).String() = %q, want %q", uint32(code), got, want)
+		}
+	}
+}
+
+func TestStatus_Err(t *testing.T) {
+	if err := New(OK, "fine").Err(); err != nil {
+		t.Errorf("OK status Err() = %v, want nil", err)
+	}
+
+	err := Errorf(NotFound, "user %d not found", 7)
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("Errorf returned %T, want *Error", err)
+	}
+	if e.Code != NotFound || e.Message != "user 7 not found" {
+		t.Errorf("Error got %v %q", e.Code, e.Message)
+	}
+	if want := "rpc error: code = NotFound desc = user 7 not found"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	if !errors.Is(fmt.Errorf("lookup: %w", err), Errorf(NotFound, "user 7 not found")) {
+		t.Error("errors.Is does not match an equal status error")
+	}
+}
+
+func TestStatus_WithDetails(t *testing.T) {
+	if _, err := New(OK, "").WithDetails(wrapperspb.Int32(1)); err == nil {
+		t.Error("WithDetails on OK status succeeded")
+	}
+
+	base := New(InvalidArgument, "bad value")
+	s, err := base.WithDetails(wrapperspb.Int32(1), wrapperspb.String("field"))
+	if err != nil {
+		t.Fatalf("WithDetails failed: %v", err)
+	}
+	if len(base.Details()) != 0 {
+		t.Error("WithDetails modified the original status")
+	}
+
+	details := Convert(s.Err()).Details()
+	if len(details) != 2 {
+		t.Fatalf("Details() has %d entries, want 2", len(details))
+	}
+	if msg, ok := details[0].(proto.Message); !ok || !proto.Equal(msg, wrapperspb.Int32(1)) {
+		t.Errorf("First detail = %v", details[0])
+	}
+	if msg, ok := details[1].(proto.Message); !ok || !proto.Equal(msg, wrapperspb.String("field")) {
+		t.Errorf("Second detail = %v", details[1])
+	}
+}
+
+func TestFromError(t *testing.T) {
+	if s, ok := FromError(nil); !ok || s.Code() != OK {
+		t.Errorf("FromError(nil) = %v, %v", s, ok)
+	}
+
+	s, ok := FromError(fmt.Errorf("wrapped: %w", Errorf(Unavailable, "down")))
+	if !ok || s.Code() != Unavailable || s.Message() != "down" {
+		t.Errorf("FromError(wrapped) = %v %q, %v", s.Code(), s.Message(), ok)
+	}
+
+	s, ok = FromError(errors.New("plain"))
+	if ok || s.Code() != Unknown || s.Message() != "plain" {
+		t.Errorf("FromError(plain) = %v %q, %v", s.Code(), s.Message(), ok)
+	}
+
+	if code := CodeOf(Errorf(PermissionDenied, "no")); code != PermissionDenied {
+		t.Errorf("CodeOf() = %v, want PermissionDenied", code)
+	}
+}
@@ -0,0 +1,682 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/jibuji/go-stream-rpc/rpc/codec"
+	"github.com/jibuji/go-stream-rpc/rpc/metadata"
+	"github.com/jibuji/go-stream-rpc/rpc/status"
+)
+
+// ServerStream is handed to server-streaming handlers, which have the
+// signature
+//
+//	func(ctx context.Context, req *Request, stream ServerStream) error
+//
+// The stream ends when the handler returns: successfully if it returns nil,
+// or with an error response otherwise.
+type ServerStream interface {
+	// Context returns the request context.
+	Context() context.Context
+	// Send sends a message to the caller.
+	Send(msg interface{}) error
+}
+
+// ClientStream receives the responses of a server-streaming call started with
+// CallStream.
+type ClientStream interface {
+	// Context returns the call context. Cancelling the context passed to
+	// CallStream aborts the call.
+	Context() context.Context
+	// Recv reads the next message into msg. It returns io.EOF once the
+	// handler has finished successfully, or the error the call ended with.
+	Recv(msg interface{}) error
+}
+
+// BidiStream is a stream of messages in both directions. It is returned by
+// OpenStream to the caller and handed to client- and bidi-streaming handlers,
+// which have the signature
+//
+//	func(ctx context.Context, stream BidiStream) error
+//
+// Client-streaming calls are bidi-streaming calls whose handler sends a single
+// message before returning.
+type BidiStream interface {
+	// Context returns the call context.
+	Context() context.Context
+	// Send sends a message to the other end. On the caller side it returns
+	// io.EOF once the handler has finished; Recv then reports the outcome.
+	Send(msg interface{}) error
+	// Recv reads the next message into msg. It returns io.EOF once the other
+	// end has finished sending: the caller called CloseSend, or the handler
+	// returned successfully. Otherwise it returns the error the call ended
+	// with.
+	Recv(msg interface{}) error
+	// CloseSend tells the other end that no more messages will be sent.
+	// The handler's side of the stream is closed when the handler returns.
+	CloseSend() error
+}
+
+var (
+	serverStreamType = reflect.TypeOf((*ServerStream)(nil)).Elem()
+	bidiStreamType   = reflect.TypeOf((*BidiStream)(nil)).Elem()
+
+	errSendClosed  = errors.New("rpc: Send called after CloseSend")
+	errRequestSent = errors.New("rpc: request of server-streaming call already sent")
+	errNoRequest   = errors.New("rpc: Recv called before the request was sent")
+
+	// errWindowExceeded fails a stream whose remote end sent a message
+	// without flow control credit left.
+	errWindowExceeded = status.Errorf(status.ResourceExhausted, "rpc: stream message exceeds the flow control window")
+)
+
+// methodKind classifies service methods by how many messages flow in each
+// direction.
+type methodKind int
+
+const (
+	unaryMethod methodKind = iota
+	serverStreamingMethod
+	bidiStreamingMethod
+)
+
+func (k methodKind) String() string {
+	switch k {
+	case serverStreamingMethod:
+		return "server-streaming"
+	case bidiStreamingMethod:
+		return "client- or bidi-streaming"
+	default:
+		return "unary"
+	}
+}
+
+// methodKindOf classifies a service method by its signature.
+func methodKindOf(methodType reflect.Type) (methodKind, bool) {
+	switch {
+	case methodType.NumIn() == 2 && methodType.In(1) == bidiStreamType:
+		return bidiStreamingMethod, true
+	case methodType.NumIn() == 2 && methodType.In(1).Kind() == reflect.Ptr: // Context and request message
+		return unaryMethod, true
+	case methodType.NumIn() == 3 && methodType.In(1).Kind() == reflect.Ptr && methodType.In(2) == serverStreamType:
+		return serverStreamingMethod, true
+	}
+	return 0, false
+}
+
+// requestedMethodKind returns the kind of method the caller expects, as told
+// by the frame that started the call.
+func requestedMethodKind(f *frame) methodKind {
+	switch {
+	case f.typ == frameStreamOpen:
+		return bidiStreamingMethod
+	case f.flags&flagStream != 0:
+		return serverStreamingMethod
+	default:
+		return unaryMethod
+	}
+}
+
+// rpcStream is one end of a streaming call. Messages received for the call
+// are queued by the read loop until the application asks for them, so a slow
+// reader never blocks the connection.
+//
+// Each direction is flow controlled by a credit window counted in message
+// bytes. The sender may only send while its window is positive, and the
+// receiver replenishes the window with window update frames as the
+// application consumes messages, so the queue stays bounded by the window
+// plus one message. A remote end sending beyond its window fails the stream
+// with status.ResourceExhausted.
+type rpcStream struct {
+	peer   *RpcPeer
+	sendID uint32 // ID stamped on outgoing frames, including the direction bit
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   *callOptions // options of the call, on the caller side
+	codec  codec.Codec  // codec of the call's messages
+
+	mu          sync.Mutex
+	queue       []*frame
+	err         error         // set once no more messages will be queued
+	sendErr     error         // set once Send must fail
+	ready       chan struct{} // signalled whenever queue or err changes
+	sendWindow  int64         // message bytes the remote end is ready to receive
+	sendReady   chan struct{} // signalled whenever sendWindow grows or sendErr is set
+	recvWindow  uint32        // receive window granted to the remote end
+	recvPending uint32        // bytes consumed but not yet granted back
+	recvCredit  int64         // bytes the remote end may still send, as granted so far
+}
+
+func newRpcStream(ctx context.Context, cancel context.CancelFunc, p *RpcPeer, sendID uint32) *rpcStream {
+	return &rpcStream{
+		peer:       p,
+		sendID:     sendID,
+		ctx:        ctx,
+		cancel:     cancel,
+		ready:      make(chan struct{}, 1),
+		sendWindow: DefaultInitialWindowSize,
+		sendReady:  make(chan struct{}, 1),
+		recvWindow: p.initialWindow,
+		recvCredit: DefaultInitialWindowSize,
+	}
+}
+
+// isCaller reports whether this is the calling end of the stream.
+func (s *rpcStream) isCaller() bool {
+	return s.sendID&RequestIDMSB == 0
+}
+
+func (s *rpcStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *rpcStream) Send(msg interface{}) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := s.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := s.peer.checkSendSize(len(payload)); err != nil {
+		return err
+	}
+
+	if err := s.acquireWindow(len(payload)); err != nil {
+		return err
+	}
+
+	if !s.isCaller() {
+		return s.peer.writeReply(s.ctx, s.sendID, frameStreamMessage, payload, false)
+	}
+	flags, payload := s.peer.compress(s.opts.compressorFor(s.peer), payload)
+	return s.peer.writeFrame(s.sendID, frameStreamMessage, flags, payload)
+}
+
+// acquireWindow blocks until the send window is positive and then takes n
+// bytes from it. The window may go negative by one message, so messages
+// larger than the window can still be sent.
+func (s *rpcStream) acquireWindow(n int) error {
+	for {
+		s.mu.Lock()
+		if s.sendErr != nil {
+			err := s.sendErr
+			s.mu.Unlock()
+			return err
+		}
+		if s.sendWindow > 0 {
+			s.sendWindow -= int64(n)
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.sendReady:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// addSendWindow grows the send window by a window update from the remote end.
+func (s *rpcStream) addSendWindow(increment uint32) {
+	s.mu.Lock()
+	s.sendWindow += int64(increment)
+	s.mu.Unlock()
+	signal(s.sendReady)
+}
+
+// consumed records that the application has read n bytes of messages and
+// grants them back to the remote end once half the window is used up.
+func (s *rpcStream) consumed(n int) {
+	s.mu.Lock()
+	s.recvPending += uint32(n)
+	var increment uint32
+	if s.err == nil && s.recvPending >= s.recvWindow/2 {
+		increment, s.recvPending = s.recvPending, 0
+	}
+	s.mu.Unlock()
+
+	if increment > 0 {
+		s.writeWindowUpdate(increment)
+	}
+}
+
+// announceWindow grants the remote end the part of the receive window that
+// exceeds the default window both ends start with.
+func (s *rpcStream) announceWindow() {
+	if s.recvWindow > DefaultInitialWindowSize {
+		s.writeWindowUpdate(s.recvWindow - DefaultInitialWindowSize)
+	}
+}
+
+func (s *rpcStream) writeWindowUpdate(increment uint32) error {
+	s.mu.Lock()
+	s.recvCredit += int64(increment)
+	s.mu.Unlock()
+
+	var body [4]byte
+	binary.BigEndian.PutUint32(body[:], increment)
+	return s.peer.writeFrame(s.sendID, frameWindowUpdate, 0, body[:])
+}
+
+func (s *rpcStream) Recv(msg interface{}) error {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			f := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			if f.typ == frameStreamMessage {
+				// The request of a server-streaming call took no window.
+				s.consumed(len(f.payload))
+			}
+			err := s.codec.Unmarshal(f.payload, msg)
+			f.release()
+			return err
+		}
+		err := s.err
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-s.ready:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+func (s *rpcStream) CloseSend() error {
+	s.mu.Lock()
+	if s.sendErr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sendErr = errSendClosed
+	s.mu.Unlock()
+	signal(s.sendReady)
+
+	// The handler's side is closed by the stream close frame sent when the
+	// handler returns.
+	if !s.isCaller() {
+		return nil
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.peer.writeFrame(s.sendID, frameHalfClose, 0, nil)
+}
+
+// deliver queues a message frame received from the remote end. Stream
+// messages are charged to the receive window; deliver reports false, and
+// drops the message, if the remote end sent it without credit left. The
+// request of a server-streaming call is not flow controlled.
+func (s *rpcStream) deliver(f *frame) bool {
+	s.mu.Lock()
+	if f.typ == frameStreamMessage {
+		if s.recvCredit <= 0 {
+			s.mu.Unlock()
+			f.release()
+			return false
+		}
+		s.recvCredit -= int64(len(f.payload))
+	}
+	if s.err == nil {
+		s.queue = append(s.queue, f)
+	}
+	s.mu.Unlock()
+	signal(s.ready)
+	return true
+}
+
+// closeRecv records that no more messages will arrive. Recv returns err once
+// the already queued messages are consumed. Only the first call has effect.
+func (s *rpcStream) closeRecv(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	signal(s.ready)
+}
+
+// finish marks the call as over: Recv returns err after the queued messages
+// and Send returns io.EOF.
+func (s *rpcStream) finish(err error) {
+	s.mu.Lock()
+	if s.sendErr == nil {
+		s.sendErr = io.EOF
+	}
+	s.mu.Unlock()
+	signal(s.sendReady)
+	s.closeRecv(err)
+}
+
+// signal wakes up a waiter on ch without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// CallStream starts a server-streaming call of methodName with a single
+// request and returns a stream from which the responses are read. The deadline
+// of ctx is propagated to the remote handler, and cancelling ctx aborts the
+// call on both ends.
+func (p *RpcPeer) CallStream(ctx context.Context, methodName string, request interface{}, opts ...CallOption) (ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stream, err := p.streamer(ctx, &StreamDesc{ServerStreams: true}, methodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(request); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// OpenStream starts a client- or bidi-streaming call of methodName. The
+// deadline of ctx is propagated to the remote handler, and cancelling ctx
+// aborts the call on both ends.
+func (p *RpcPeer) OpenStream(ctx context.Context, methodName string, opts ...CallOption) (BidiStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return p.streamer(ctx, &StreamDesc{ClientStreams: true, ServerStreams: true}, methodName, opts...)
+}
+
+// newStream starts a streaming call on the connection. It is the end of the
+// client interceptor chain.
+func (p *RpcPeer) newStream(ctx context.Context, desc *StreamDesc, methodName string, opts ...CallOption) (BidiStream, error) {
+	o := newCallOptions(opts)
+	if !desc.ClientStreams {
+		return &serverStreamCall{peer: p, ctx: ctx, opts: o, method: methodName}, nil
+	}
+	cdc, err := o.codecFor(p)
+	if err != nil {
+		return nil, err
+	}
+	return p.startStream(ctx, o, cdc, frameStreamOpen, methodName, 0, nil)
+}
+
+// serverStreamCall is the caller's end of a server-streaming call. The call
+// starts when the request is sent with the first Send.
+type serverStreamCall struct {
+	peer   *RpcPeer
+	ctx    context.Context
+	opts   *callOptions
+	method string
+	stream *rpcStream // set once the request has been sent
+}
+
+func (c *serverStreamCall) Context() context.Context {
+	if c.stream != nil {
+		return c.stream.ctx
+	}
+	return c.ctx
+}
+
+func (c *serverStreamCall) Send(msg interface{}) error {
+	if c.stream != nil {
+		return errRequestSent
+	}
+
+	cdc, err := c.opts.codecFor(c.peer)
+	if err != nil {
+		return err
+	}
+	payload, err := cdc.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := c.peer.checkSendSize(len(payload)); err != nil {
+		return err
+	}
+
+	flags, payload := c.peer.compress(c.opts.compressorFor(c.peer), payload)
+	stream, err := c.peer.startStream(c.ctx, c.opts, cdc, frameRequest, c.method, flagStream|flags, payload)
+	if err != nil {
+		return err
+	}
+	c.stream = stream
+	return nil
+}
+
+func (c *serverStreamCall) Recv(msg interface{}) error {
+	if c.stream == nil {
+		return errNoRequest
+	}
+	return c.stream.Recv(msg)
+}
+
+// CloseSend does nothing: the request is all the caller sends.
+func (c *serverStreamCall) CloseSend() error {
+	return nil
+}
+
+// startStream registers an outgoing stream whose messages are encoded with
+// cdc and sends the frame that starts the call.
+func (p *RpcPeer) startStream(ctx context.Context, o *callOptions, cdc codec.Codec, typ frameType, methodName string, flags uint8, payload []byte) (*rpcStream, error) {
+	if err := p.Handshake(ctx); err != nil {
+		return nil, err
+	}
+	if p.Features()&FeatureStreaming == 0 {
+		return nil, status.Errorf(status.Unimplemented, "remote peer does not support streaming")
+	}
+
+	requestID := p.getNextRequestID()
+	ctx, cancel := o.context(ctx)
+	stream := newRpcStream(ctx, cancel, p, requestID)
+	stream.opts = o
+	stream.codec = cdc
+
+	p.mu.Lock()
+	if err := p.callsRefused(); err != nil {
+		p.mu.Unlock()
+		cancel()
+		return nil, err
+	}
+	p.streams[requestID] = stream
+	p.mu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if err := p.writeRequest(typ, requestID, methodName, cdc.Name(), flags, deadline, md, payload); err != nil {
+		p.removeStream(requestID)
+		cancel()
+		return nil, err
+	}
+
+	stream.announceWindow()
+
+	context.AfterFunc(ctx, func() {
+		// Still registered means the call was abandoned before it finished.
+		if p.removeStream(requestID) {
+			p.writeCancel(requestID)
+		}
+		stream.finish(ctx.Err())
+	})
+
+	return stream, nil
+}
+
+// removeStream unregisters the outgoing stream with the given ID and reports
+// whether it was still registered.
+func (p *RpcPeer) removeStream(requestID uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.streams[requestID]
+	delete(p.streams, requestID)
+	p.checkDrained()
+	return ok
+}
+
+// dispatchStreamFrame routes a frame sent by the handler of an outgoing
+// streaming call.
+func (p *RpcPeer) dispatchStreamFrame(stream *rpcStream, f *frame) {
+	stream.opts.received(f)
+
+	if f.recvErr != nil {
+		// Abandon the call; cancelling the stream tells the handler.
+		stream.finish(f.recvErr)
+		stream.cancel()
+		return
+	}
+
+	switch f.typ {
+	case frameStreamMessage:
+		if !stream.deliver(f) {
+			// Abandon the call; cancelling the stream tells the handler.
+			stream.finish(errWindowExceeded)
+			stream.cancel()
+		}
+		return
+	case frameWindowUpdate:
+		if increment, ok := windowIncrement(f); ok {
+			stream.addSendWindow(increment)
+		}
+		f.release()
+		return
+	case frameStreamClose:
+		stream.finish(io.EOF)
+	case frameError:
+		stream.finish(p.callError(f))
+	default:
+		stream.finish(status.Errorf(status.Internal, "unexpected frame type %d on streaming call", f.typ))
+	}
+
+	// The call is over; release its context.
+	stream.cancel()
+}
+
+// acceptStream registers the handler's end of a stream opened by the remote
+// peer.
+func (p *RpcPeer) acceptStream(ctx context.Context, requestID uint32) *rpcStream {
+	stream := newRpcStream(ctx, nil, p, requestID|RequestIDMSB)
+	stream.codec = handlerCallFrom(ctx).codec
+
+	p.mu.Lock()
+	p.remoteStreams[requestID] = stream
+	p.mu.Unlock()
+
+	return stream
+}
+
+// dispatchRemoteStreamFrame routes a frame sent by the caller of a stream
+// this peer is handling.
+func (p *RpcPeer) dispatchRemoteStreamFrame(f *frame) {
+	p.mu.Lock()
+	stream, ok := p.remoteStreams[f.id]
+	p.mu.Unlock()
+
+	if !ok {
+		// The handler already returned; drop whatever is still in flight.
+		return
+	}
+
+	if f.recvErr != nil {
+		// The handler's Recv reports the error; further messages are
+		// dropped.
+		stream.closeRecv(f.recvErr)
+		return
+	}
+
+	switch f.typ {
+	case frameStreamMessage:
+		if !stream.deliver(f) {
+			// Fail the call at once rather than wait for the handler,
+			// and only then stop the handler, whose own reply the
+			// caller drops.
+			stream.closeRecv(errWindowExceeded)
+			go func(id uint32) {
+				p.writeHandlerError(p.ctx, id, errWindowExceeded)
+				p.cancelRequest(id)
+			}(f.id)
+		}
+	case frameHalfClose:
+		stream.closeRecv(io.EOF)
+	case frameWindowUpdate:
+		if increment, ok := windowIncrement(f); ok {
+			stream.addSendWindow(increment)
+		}
+		f.release()
+	}
+}
+
+// windowIncrement decodes the body of a window update frame.
+func windowIncrement(f *frame) (uint32, bool) {
+	if len(f.payload) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(f.payload), true
+}
+
+// failStreams ends every outgoing stream with err. It is used when the
+// connection goes away.
+func (p *RpcPeer) failStreams(err error) {
+	p.mu.Lock()
+	streams := p.streams
+	p.streams = make(map[uint32]*rpcStream)
+	p.checkDrained()
+	p.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.finish(err)
+		stream.cancel()
+	}
+}
+
+// handleStream runs a streaming handler through the stream interceptors and
+// ends the stream with the handler's outcome.
+func (p *RpcPeer) handleStream(f *frame, srv interface{}, handler StreamHandler, kind methodKind, stream *rpcStream) {
+	if kind == serverStreamingMethod {
+		// The request is the one message the handler receives.
+		stream.deliver(f)
+		stream.closeRecv(io.EOF)
+	}
+
+	info := &StreamServerInfo{
+		FullMethod:     f.method,
+		IsClientStream: kind == bidiStreamingMethod,
+		IsServerStream: true,
+	}
+	handler = chainStreamHandler(p.streamServerInterceptors, info, handler)
+
+	p.endStream(f.id, stream, handler(srv, stream))
+}
+
+// endStream closes the handler's end of a stream with the error returned by
+// the handler.
+func (p *RpcPeer) endStream(requestID uint32, stream *rpcStream, err error) {
+	stream.finish(io.EOF)
+
+	if err != nil {
+		p.writeHandlerError(stream.ctx, requestID, err)
+		return
+	}
+
+	p.writeReply(stream.ctx, requestID|RequestIDMSB, frameStreamClose, nil, true)
+}